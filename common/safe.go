@@ -1,6 +1,7 @@
 package common
 
 import (
+	"context"
 	"net/http"
 	"runtime"
 
@@ -19,7 +20,7 @@ func CheckWrapPanic() bool {
 	return panicProtection
 }
 
-func GoSafeTCP(ch chan []byte, req interface{}, fn func(chan []byte, interface{})) {
+func GoSafeTCP(ctx context.Context, ch chan []byte, req interface{}, fn func(context.Context, chan []byte, interface{})) {
 	defer func() {
 		if err := recover(); err != nil {
 			stack := make([]byte, 1024*8)
@@ -28,7 +29,7 @@ func GoSafeTCP(ch chan []byte, req interface{}, fn func(chan []byte, interface{}
 			log.ERRORF(f, err, stack)
 		}
 	}()
-	fn(ch, req)
+	fn(ctx, ch, req)
 }
 
 func GoSafeHTTP(rw http.ResponseWriter, r *http.Request, fn func(http.ResponseWriter, *http.Request)) {
@@ -55,6 +56,18 @@ func GoSafeTimer(fn func()) {
 	fn()
 }
 
+func GoSafeContext(ctx context.Context, fn func(context.Context)) {
+	defer func() {
+		if err := recover(); err != nil {
+			stack := make([]byte, 1024*8)
+			stack = stack[:runtime.Stack(stack, false)]
+			f := "[PANIC] %s\n%s"
+			log.ERRORF(f, err, stack)
+		}
+	}()
+	fn(ctx)
+}
+
 func GoSafe(fn func(...interface{}), args ...interface{}) {
 	defer func() {
 		if err := recover(); err != nil {
@@ -2,4 +2,8 @@ module github.com/xuhn/optimusprime
 
 go 1.14
 
-require github.com/revel/pathtree v0.0.0-20140121041023-41257a1839e9
+require (
+	github.com/revel/pathtree v0.0.0-20140121041023-41257a1839e9
+	github.com/vmihailenco/msgpack/v4 v4.3.13
+	google.golang.org/protobuf v1.28.1
+)
@@ -1,34 +1,119 @@
 package net
 
 import (
+	"context"
 	"errors"
 	"io"
 	"net"
 	"net/http"
 	"strconv"
+	"sync/atomic"
 )
 
 // tcp
+// listen_addr为unix:/path.sock时监听Unix socket, 忽略listen_port
 func ListenAndServeTCP(listen_addr string, listen_port int) (err error) {
-	var listener net.Listener
-	listen_ip, err := parseListenAddr(listen_addr)
+	listener, err := listenTCP(listen_addr, listen_port)
 	if err != nil {
 		return
 	}
-	address := net.JoinHostPort(listen_ip, strconv.Itoa(listen_port))
-	if listener, err = net.Listen("tcp", address); err != nil {
+	server, err := newTcpServer(listener, nil)
+	if err != nil {
+		listener.Close()
 		return
 	}
-	server := newTcpServer(listener)
 	server.serve()
 	return
 }
 
+// 非阻塞启动TCP服务, 返回的句柄可用于优雅关闭
+func StartTCPServer(listen_addr string, listen_port int) (server *TCPServer, err error) {
+	return StartTCPServerWithConfig(listen_addr, listen_port, nil)
+}
+
+// 按配置非阻塞启动TCP服务, config为空时使用默认配置
+func StartTCPServerWithConfig(listen_addr string, listen_port int, config *TCPServerConfig) (server *TCPServer, err error) {
+	listener, err := listenTCP(listen_addr, listen_port)
+	if err != nil {
+		return
+	}
+	s, err := newTcpServer(listener, config)
+	if err != nil {
+		listener.Close()
+		return
+	}
+	server = &TCPServer{s: s}
+	go server.s.serve()
+	return
+}
+
+// 按名称查找运行中的TCP服务, 服务名称由TCPServerConfig.Name指定
+func TCPServerByName(name string) (server *TCPServer, ok bool) {
+	return getTcpServer(name)
+}
+
+// 运行中的具名TCP服务, 按名称排序
+func TCPServers() []*TCPServer {
+	return getTcpServers()
+}
+
+// 从配置文件读取TCP服务的TLS配置, 配置格式:
+// "tcp": {"tls": {"cert_file": "server.crt", "key_file": "server.key", "ca_file": "ca.crt", "client_auth": true}}
+func TCPServerTLSFromConfig() (*TLSConfig, error) {
+	return tlsConfigFromConfig("tcp.tls")
+}
+
+// 设置TCP客户端心跳, 对新建立的连接生效, config为空时关闭
+// 开启后新连接使用支持控制帧的编解码器, 服务端需同时开启心跳; 只有多路复用连接在收到服务端的ping后才主动发送ping
+func SetTCPClientHeartbeat(config *HeartbeatConfig) {
+	setClientHeartbeat(config)
+}
+
+// 设置访问指定地址时使用TLS, config为空时取消; 会关闭该地址上已建立的空闲连接
+func SetTCPClientTLS(s_peer_addr string, i_peer_port int, config *TLSConfig) error {
+	return setClientTLS(clientRemoteAddr(s_peer_addr, i_peer_port), config)
+}
+
 func SetTCPClientConnLimit(limit int) {
 	setClientConnectionLimit(limit)
 }
 
-// 带回包的请求
+// 设置TCP客户端连接池配置
+func SetTCPClientPoolConfig(config TCPClientPoolConfig) {
+	clientPool.setConfig(config)
+}
+
+// TCP客户端连接池统计(所有地址汇总)
+func TCPClientPoolStatsAll() TCPClientPoolStats {
+	return clientPool.stats()
+}
+
+// TCP客户端连接池中指定地址的统计
+func TCPClientPoolStatsByAddr(s_peer_addr string, i_peer_port int) TCPClientPoolStats {
+	return clientPool.addrStats(clientRemoteAddr(s_peer_addr, i_peer_port))
+}
+
+// 设置TCP客户端最大回包长度, 0使用默认值, 小于0不限制
+func SetTCPClientMaxFrameSize(size int) {
+	setClientMaxFrameSize(size)
+}
+
+// 因协议错误(如超过最大长度)被拒绝的数据包总数
+func TCPRejectedFrames() uint64 {
+	return atomic.LoadUint64(&rejectedFrameCount)
+}
+
+// 设置TCP客户端默认的数据包编解码
+func SetTCPClientCodec(codec Codec) {
+	setClientCodec(codec)
+}
+
+// 设置访问指定地址时使用的数据包编解码, codec为空时恢复默认
+func SetTCPClientAddrCodec(s_peer_addr string, i_peer_port int, codec Codec) {
+	setClientAddrCodec(s_peer_addr, i_peer_port, codec)
+}
+
+// 带回包的请求, s_peer_addr为unix:/path.sock时通过Unix socket访问, 忽略i_peer_port
 func SendTCPRequest(s_peer_addr string, i_peer_port int, req []byte, timeOut uint32) (res []byte, err error) {
 	return sendClientRequest(s_peer_addr, i_peer_port, req, timeOut)
 }
@@ -38,6 +123,54 @@ func SendTCPRequestNoResponse(s_peer_addr string, i_peer_port int, req []byte, t
 	return sendClientRequestNoResponse(s_peer_addr, i_peer_port, req, timeOut)
 }
 
+// 带回包的请求, addr格式为host:port或unix:/path.sock, 遵循ctx的取消和deadline
+func SendTCPRequestContext(ctx context.Context, addr string, req []byte) (res []byte, err error) {
+	return sendClientRequestContext(ctx, addr, req, true)
+}
+
+// 不带回包的请求, addr格式为host:port或unix:/path.sock, 遵循ctx的取消和deadline
+func SendTCPRequestNoResponseContext(ctx context.Context, addr string, req []byte) (err error) {
+	_, err = sendClientRequestContext(ctx, addr, req, false)
+	return
+}
+
+// 开启访问指定地址的多路复用模式, 所有请求共享connNum个连接, connNum<=0关闭
+// 多路复用模式下请求前加4字节请求序号, 服务端需使用ParseTCPMuxRequest/SendTCPMuxResponse处理
+func SetTCPClientMultiplex(s_peer_addr string, i_peer_port int, connNum int) {
+	setClientMultiplex(clientRemoteAddr(s_peer_addr, i_peer_port), connNum)
+}
+
+// 解析多路复用请求, 返回请求序号和请求内容
+func ParseTCPMuxRequest(msg []byte) (seq uint32, req []byte, err error) {
+	return parseMuxRequest(msg)
+}
+
+// 多路复用请求的回包, seq为请求序号
+func SendTCPMuxResponse(connection *TcpConnection, seq uint32, res []byte) (err error) {
+	return sendMuxResponse(connection, seq, res)
+}
+
+// 注册upstream, 同名upstream会被替换
+func RegisterTCPUpstream(name string, config UpstreamConfig) error {
+	return registerUpstream(name, config)
+}
+
+// 从配置文件tcp.upstreams加载upstream
+func LoadTCPUpstreamsFromConfig() error {
+	return loadUpstreamsFromConfig()
+}
+
+// 按upstream负载均衡发送带回包的请求, key用于一致性哈希, 其他策略忽略
+func SendTCPUpstreamRequest(ctx context.Context, name string, key string, req []byte) (res []byte, err error) {
+	return sendUpstreamRequest(ctx, name, key, req, true)
+}
+
+// 按upstream负载均衡发送不带回包的请求
+func SendTCPUpstreamRequestNoResponse(ctx context.Context, name string, key string, req []byte) (err error) {
+	_, err = sendUpstreamRequest(ctx, name, key, req, false)
+	return
+}
+
 func SendTCPResponse(connection *TcpConnection, res []byte) (err error) {
 	_, err = connection.Send(res)
 	return
@@ -52,7 +185,65 @@ func IsIPv4(ip string) bool {
 }
 
 func NewTcpConnection(conn net.Conn) *TcpConnection {
-	return newTcpConnection(conn)
+	return newTcpConnection(conn, nil)
+}
+
+func NewTcpConnectionWithCodec(conn net.Conn, codec Codec) *TcpConnection {
+	return newTcpConnection(conn, codec)
+}
+
+// udp
+func ListenAndServeUDP(listen_addr string, listen_port int) (err error) {
+	conn, err := listenUDP(listen_addr, listen_port)
+	if err != nil {
+		return
+	}
+	return newUdpServer(conn, nil).serve()
+}
+
+// 按配置非阻塞启动UDP服务, config为空时使用默认配置
+func StartUDPServer(listen_addr string, listen_port int, config *UDPServerConfig) (server *UDPServer, err error) {
+	conn, err := listenUDP(listen_addr, listen_port)
+	if err != nil {
+		return
+	}
+	server = &UDPServer{s: newUdpServer(conn, config)}
+	go server.s.serve()
+	return
+}
+
+// 带回包的UDP请求, 请求前加4字节请求id, 服务端需使用ParseUDPRequest/SendUDPResponse处理
+// timeOut单位为秒, 为0时使用默认超时(3秒)
+func SendUDPRequest(s_peer_addr string, i_peer_port int, req []byte, timeOut uint32) (res []byte, err error) {
+	ctx, cancel := timeoutContext(timeOut)
+	defer cancel()
+	return sendUDPRequestContext(ctx, clientRemoteAddr(s_peer_addr, i_peer_port), req, true)
+}
+
+// 带回包的UDP请求, addr格式为host:port, 遵循ctx的取消和deadline; ctx没有deadline时使用默认超时(3秒)
+func SendUDPRequestContext(ctx context.Context, addr string, req []byte) (res []byte, err error) {
+	return sendUDPRequestContext(ctx, addr, req, true)
+}
+
+// 不带回包的UDP请求
+func SendUDPRequestNoResponse(s_peer_addr string, i_peer_port int, req []byte) (err error) {
+	_, err = sendUDPRequestContext(context.Background(), clientRemoteAddr(s_peer_addr, i_peer_port), req, false)
+	return
+}
+
+// 解析UDP请求, 返回请求id和请求内容
+func ParseUDPRequest(msg []byte) (id uint32, req []byte, err error) {
+	return parseUDPRequest(msg)
+}
+
+// UDP请求的回包, id为请求id
+func SendUDPResponse(session *UDPSession, id uint32, res []byte) (err error) {
+	return sendUDPResponse(session, id, res)
+}
+
+// 关闭到对端地址的UDP socket, 等待中的请求返回ErrUDPClosed; 空闲的socket也会被定期关闭
+func CloseUDPClient(s_peer_addr string, i_peer_port int) {
+	closeUDPClient(clientRemoteAddr(s_peer_addr, i_peer_port))
 }
 
 // http
@@ -100,6 +291,33 @@ func SendHTTPMethodRequest(method, uri string, body io.Reader, timeOut uint32) (
 	return sendHttpMethodRequest(method, uri, body, timeOut)
 }
 
+// 开启熔断, 对所有tcp地址(host:port)和http host生效, config为空关闭
+// 网络错误和http 5xx响应计入失败, 调用方取消的请求不计入
+func SetCircuitBreaker(config *BreakerConfig) {
+	setBreakerConfig("", config)
+}
+
+// 为指定目标单独设置熔断配置, config为空恢复使用全局配置
+func SetTargetCircuitBreaker(target string, config *BreakerConfig) {
+	setBreakerConfig(target, config)
+}
+
+// 设置重试策略, 只对幂等请求生效, policy为空关闭重试
+// http请求按方法判断幂等(POST不重试), tcp请求需使用WithIdempotent标记
+func SetRetryPolicy(policy *RetryPolicy) {
+	setRetryPolicy(policy)
+}
+
+// 标记请求为幂等, 用于SendTCPRequestContext等带ctx的请求
+func WithIdempotent(ctx context.Context) context.Context {
+	return withIdempotent(ctx)
+}
+
+// 获取目标的熔断统计
+func GetCircuitBreakerStats(target string) CircuitBreakerStats {
+	return getCircuitBreakerStats(target)
+}
+
 //ratelimit
 func InitRateLimit(strategy string, rate float32, capacity int64) error {
 	if rate <= 0.0 || capacity <= 0 {
@@ -1,7 +1,8 @@
-
 package net
 
 import (
+	"context"
+	"errors"
 	"io"
 	"io/ioutil"
 	"net"
@@ -10,6 +11,9 @@ import (
 	"time"
 )
 
+// 服务端返回5xx, 只在熔断和重试内部使用
+var errHttpServerStatus = errors.New("http server error status")
+
 func sendHttpRequest(url_path string, params map[string]interface{}, timeOut uint32) (res []byte, err error) {
 
 	req_url, err := url.Parse(url_path)
@@ -23,41 +27,67 @@ func sendHttpRequest(url_path string, params map[string]interface{}, timeOut uin
 	req_url.RawQuery = req_params.Encode()
 	// 设置超时，如果为0,则不超时
 	client := newTimeoutHTTPClient(time.Duration(timeOut) * time.Second)
-	result, err := client.Get(req_url.String())
-	if err != nil {
-		return
-	}
-	defer result.Body.Close()
-	res, err = ioutil.ReadAll(result.Body)
-	return
+	return doHttpRequest(client, http.MethodGet, req_url.String(), "", nil)
 }
 
 func sendHttpPostRequest(url_path string, body_type string, body io.Reader, timeOut uint32) (res []byte, err error) {
 	client := newTimeoutHTTPClient(time.Duration(timeOut) * time.Second)
-	result, err := client.Post(url_path, body_type, body)
-	if err != nil {
-		return
-	}
-	defer result.Body.Close()
-	res, err = ioutil.ReadAll(result.Body)
-	return
+	return doHttpRequest(client, http.MethodPost, url_path, body_type, body)
 }
 
 func sendHttpMethodRequest(method string, url_path string, body io.Reader, timeOut uint32) (res []byte, err error) {
-	http_request, err := http.NewRequest(method, url_path, body)
+	client := newTimeoutHTTPClient(time.Duration(timeOut) * time.Second)
+	return doHttpRequest(client, method, url_path, "", body)
+}
+
+// 按熔断和重试策略发送http请求, 幂等方法且body可重读时才会重试
+func doHttpRequest(client *http.Client, method string, url_path string, body_type string, body io.Reader) (res []byte, err error) {
+	req_url, err := url.Parse(url_path)
 	if err != nil {
 		return
 	}
-	client := newTimeoutHTTPClient(time.Duration(timeOut) * time.Second)
-	result, err := client.Do(http_request)
-	if err != nil {
+	seeker, seekable := body.(io.Seeker)
+	idempotent := isIdempotentMethod(method) && (body == nil || seekable)
+	attempt := 0
+	err = callWithResilience(context.Background(), req_url.Host, idempotent, func() (e error) {
+		if attempt > 0 && seekable {
+			if _, e = seeker.Seek(0, io.SeekStart); e != nil {
+				return
+			}
+		}
+		attempt++
+		http_request, e := http.NewRequest(method, url_path, body)
+		if e != nil {
+			return
+		}
+		if body_type != "" {
+			http_request.Header.Set("Content-Type", body_type)
+		}
+		result, e := client.Do(http_request)
+		if e != nil {
+			return
+		}
+		defer result.Body.Close()
+		if res, e = ioutil.ReadAll(result.Body); e == nil && result.StatusCode >= http.StatusInternalServerError {
+			e = errHttpServerStatus
+		}
 		return
+	})
+	// 5xx计入熔断失败并按策略重试, 最终仍返回响应内容
+	if err == errHttpServerStatus {
+		err = nil
 	}
-	defer result.Body.Close()
-	res, err = ioutil.ReadAll(result.Body)
 	return
 }
 
+func isIdempotentMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodTrace, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return false
+}
+
 func dialHTTPTimeout(timeOut time.Duration) func(net, addr string) (net.Conn, error) {
 	return func(network, addr string) (c net.Conn, err error) {
 		c, err = net.DialTimeout(network, addr, timeOut)
@@ -104,6 +104,21 @@ func (tb *Bucket) Cal(n int64) time.Duration {
 	return waitTime
 }
 
+//非阻塞获取n个令牌, 令牌不足时返回false且不消耗令牌
+func (tb *Bucket) TryTake(n int64) bool {
+	if n <= 0 {
+		return true
+	}
+	tb.Lock()
+	defer tb.Unlock()
+	tb.adjust(time.Now())
+	if tb.avail < n {
+		return false
+	}
+	tb.avail -= n
+	return true
+}
+
 func (tb *Bucket) adjust(now time.Time) int64 {
 	currentTick := int64(now.Sub(tb.startTime) / tb.fillInterval)
 	if tb.avail >= tb.capacity {
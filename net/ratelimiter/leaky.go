@@ -92,6 +92,25 @@ func (lb *LeakyBucket) Cal(n int64) time.Duration {
 	return waitTime
 }
 
+//非阻塞放入n个单位, 桶满时返回false
+func (lb *LeakyBucket) TryTake(n int64) bool {
+	if n <= 0 {
+		return true
+	}
+	lb.Lock()
+	defer lb.Unlock()
+	currentTick := lb.adjust(time.Now())
+	if lb.inBucket == 0 {
+		//桶为空时adjust不更新availTick, 从当前tick开始计算流出
+		lb.availTick = currentTick
+	}
+	if lb.inBucket+n > lb.capacity {
+		return false
+	}
+	lb.inBucket += n
+	return true
+}
+
 func (lb *LeakyBucket) adjust(now time.Time) int64 {
 	currentTick := int64(now.Sub(lb.startTime) / lb.emissionInterval)
 	if lb.inBucket <= 0 {
@@ -35,6 +35,18 @@ func (rl *RateLimit) Stop(n int64) {
 	return
 }
 
+//非阻塞的流量控制, 超出速率时返回false, 用于需要丢弃而不是等待的场景
+func (rl *RateLimit) Allow(n int64) bool {
+	if t, ok := rl.ratelimiter.(tryTaker); ok {
+		return t.TryTake(n)
+	}
+	return true
+}
+
+type tryTaker interface {
+	TryTake(n int64) bool
+}
+
 func (rl *RateLimit) Strategy() string {
 	return rl.strategy
 }
@@ -21,3 +21,18 @@ func Test_NewBucket(t *testing.T) {
 	tb.Wait(18000)
 	t.Log("wait 4")
 }
+
+func Test_Allow(t *testing.T) {
+	for _, strategy := range []string{"token", "leaky"} {
+		rl := NewRateLimit(strategy, 10, 5)
+		allowed := 0
+		for i := 0; i < 20; i++ {
+			if rl.Allow(1) {
+				allowed++
+			}
+		}
+		if allowed != 5 {
+			t.Errorf("%s allowed %d, want 5", strategy, allowed)
+		}
+	}
+}
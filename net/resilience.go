@@ -0,0 +1,373 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/xuhn/optimusprime/log"
+)
+
+// 熔断器状态
+type CircuitState int32
+
+const (
+	CircuitClosed CircuitState = iota
+	CircuitOpen
+	CircuitHalfOpen
+)
+
+func (s CircuitState) String() string {
+	switch s {
+	case CircuitClosed:
+		return "closed"
+	case CircuitOpen:
+		return "open"
+	case CircuitHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+var (
+	ErrCircuitOpen = errors.New("circuit breaker is open")
+)
+
+// 熔断状态变化时调用, target为tcp地址(host:port)或http的host;
+// 在锁外同步调用, 同一目标的状态变化按发生顺序依次回调
+var OnCircuitStateChange = func(target string, from, to CircuitState) {}
+
+// 熔断器配置
+type BreakerConfig struct {
+	// 连续失败次数达到后熔断
+	FailureThreshold int
+	// 熔断持续时间, 之后进入半开状态
+	OpenTimeout time.Duration
+	// 半开状态允许同时进行的探测请求数
+	HalfOpenMaxCalls int
+	// 半开状态连续成功次数达到后恢复
+	SuccessThreshold int
+}
+
+// 重试策略, 只对幂等请求生效
+type RetryPolicy struct {
+	// 总尝试次数(含首次), 小于等于1不重试
+	MaxAttempts int
+	// 首次重试等待时间
+	BaseDelay time.Duration
+	// 最大等待时间, 0不限制
+	MaxDelay time.Duration
+	// 退避倍数, 默认2
+	Multiplier float64
+	// 随机抖动比例(0~1), 等待时间在[delay*(1-Jitter), delay]之间
+	Jitter float64
+}
+
+// 单个目标的熔断统计
+type CircuitBreakerStats struct {
+	State       CircuitState
+	Requests    int64 // 请求数
+	Failures    int64 // 失败数
+	Rejected    int64 // 熔断拒绝数
+	Retries     int64 // 重试次数
+	Transitions int64 // 状态变化次数
+}
+
+type circuitBreaker struct {
+	target string
+	config BreakerConfig
+
+	mu            sync.Mutex
+	state         CircuitState
+	failures      int
+	successes     int
+	halfOpenCalls int
+	openedAt      time.Time
+	stats         CircuitBreakerStats
+	// 待回调的状态变化, 由notifyMu保证按顺序回调
+	pending  []circuitTransition
+	notifyMu sync.Mutex
+}
+
+type circuitTransition struct {
+	from, to CircuitState
+}
+
+var (
+	resilienceMu    sync.RWMutex
+	breakerConfig   *BreakerConfig
+	targetBreakers  = make(map[string]*BreakerConfig)
+	retryPolicy     *RetryPolicy
+	circuitBreakers = make(map[string]*circuitBreaker)
+)
+
+type idempotentKey struct{}
+
+// 标记请求为幂等, 允许按重试策略重试
+func withIdempotent(ctx context.Context) context.Context {
+	return context.WithValue(ctx, idempotentKey{}, true)
+}
+
+func isIdempotent(ctx context.Context) bool {
+	v, _ := ctx.Value(idempotentKey{}).(bool)
+	return v
+}
+
+func setBreakerConfig(target string, config *BreakerConfig) {
+	if config != nil {
+		c := normalizeBreakerConfig(*config)
+		config = &c
+	}
+	resilienceMu.Lock()
+	defer resilienceMu.Unlock()
+	if target == "" {
+		breakerConfig = config
+	} else if config == nil {
+		delete(targetBreakers, target)
+	} else {
+		targetBreakers[target] = config
+	}
+	// 配置变化后重新创建熔断器
+	circuitBreakers = make(map[string]*circuitBreaker)
+}
+
+func normalizeBreakerConfig(config BreakerConfig) BreakerConfig {
+	if config.FailureThreshold <= 0 {
+		config.FailureThreshold = 5
+	}
+	if config.OpenTimeout <= 0 {
+		config.OpenTimeout = 10 * time.Second
+	}
+	if config.HalfOpenMaxCalls <= 0 {
+		config.HalfOpenMaxCalls = 1
+	}
+	if config.SuccessThreshold <= 0 {
+		config.SuccessThreshold = 1
+	}
+	return config
+}
+
+func setRetryPolicy(policy *RetryPolicy) {
+	if policy != nil {
+		p := *policy
+		if p.Multiplier < 1 {
+			p.Multiplier = 2
+		}
+		if p.Jitter < 0 {
+			p.Jitter = 0
+		} else if p.Jitter > 1 {
+			p.Jitter = 1
+		}
+		policy = &p
+	}
+	resilienceMu.Lock()
+	retryPolicy = policy
+	resilienceMu.Unlock()
+}
+
+func getRetryPolicy() *RetryPolicy {
+	resilienceMu.RLock()
+	defer resilienceMu.RUnlock()
+	return retryPolicy
+}
+
+// 获取目标的熔断器, 未开启熔断时返回nil
+func getCircuitBreaker(target string) *circuitBreaker {
+	resilienceMu.RLock()
+	b, ok := circuitBreakers[target]
+	config, hasTarget := targetBreakers[target]
+	if !hasTarget {
+		config = breakerConfig
+	}
+	resilienceMu.RUnlock()
+	if ok || config == nil {
+		return b
+	}
+
+	resilienceMu.Lock()
+	defer resilienceMu.Unlock()
+	if b, ok = circuitBreakers[target]; !ok {
+		b = &circuitBreaker{target: target, config: *config}
+		circuitBreakers[target] = b
+	}
+	return b
+}
+
+func getCircuitBreakerStats(target string) (stats CircuitBreakerStats) {
+	resilienceMu.RLock()
+	b, ok := circuitBreakers[target]
+	resilienceMu.RUnlock()
+	if !ok {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	stats = b.stats
+	stats.State = b.state
+	return
+}
+
+// 请求前检查是否允许通过
+func (b *circuitBreaker) allow() error {
+	b.mu.Lock()
+	defer b.notify()
+	defer b.mu.Unlock()
+	b.stats.Requests++
+	if b.state == CircuitOpen {
+		if time.Since(b.openedAt) < b.config.OpenTimeout {
+			b.stats.Rejected++
+			return ErrCircuitOpen
+		}
+		b.setState(CircuitHalfOpen)
+	}
+	if b.state == CircuitHalfOpen {
+		if b.halfOpenCalls >= b.config.HalfOpenMaxCalls {
+			b.stats.Rejected++
+			return ErrCircuitOpen
+		}
+		b.halfOpenCalls++
+	}
+	return nil
+}
+
+// 记录请求结果
+func (b *circuitBreaker) report(success bool) {
+	b.mu.Lock()
+	defer b.notify()
+	defer b.mu.Unlock()
+	if b.state == CircuitHalfOpen && b.halfOpenCalls > 0 {
+		b.halfOpenCalls--
+	}
+	if success {
+		b.failures = 0
+		if b.state == CircuitHalfOpen {
+			b.successes++
+			if b.successes >= b.config.SuccessThreshold {
+				b.setState(CircuitClosed)
+			}
+		}
+		return
+	}
+	b.stats.Failures++
+	switch b.state {
+	case CircuitHalfOpen:
+		b.setState(CircuitOpen)
+	case CircuitClosed:
+		b.failures++
+		if b.failures >= b.config.FailureThreshold {
+			b.setState(CircuitOpen)
+		}
+	}
+}
+
+// 释放半开状态的探测名额, 不计入成功或失败; 用于调用方取消的请求
+func (b *circuitBreaker) release() {
+	b.mu.Lock()
+	if b.state == CircuitHalfOpen && b.halfOpenCalls > 0 {
+		b.halfOpenCalls--
+	}
+	b.mu.Unlock()
+}
+
+func (b *circuitBreaker) addRetry() {
+	b.mu.Lock()
+	b.stats.Retries++
+	b.mu.Unlock()
+}
+
+// 需持有锁
+func (b *circuitBreaker) setState(state CircuitState) {
+	from := b.state
+	if from == state {
+		return
+	}
+	b.state = state
+	b.failures = 0
+	b.successes = 0
+	b.halfOpenCalls = 0
+	if state == CircuitOpen {
+		b.openedAt = time.Now()
+	}
+	b.stats.Transitions++
+	log.WARNF("circuit breaker [%s] %s -> %s", b.target, from, state)
+	b.pending = append(b.pending, circuitTransition{from, state})
+}
+
+// 在锁外按顺序回调状态变化
+func (b *circuitBreaker) notify() {
+	b.mu.Lock()
+	empty := len(b.pending) == 0
+	b.mu.Unlock()
+	if empty {
+		return
+	}
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+	b.mu.Lock()
+	pending := b.pending
+	b.pending = nil
+	b.mu.Unlock()
+	for _, t := range pending {
+		OnCircuitStateChange(b.target, t.from, t.to)
+	}
+}
+
+// 第attempt次重试前的等待时间(attempt从1开始)
+func (p *RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.BaseDelay) * math.Pow(p.Multiplier, float64(attempt-1))
+	if p.MaxDelay > 0 && delay > float64(p.MaxDelay) {
+		delay = float64(p.MaxDelay)
+	}
+	if p.Jitter > 0 {
+		delay -= delay * p.Jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// 调用方取消的请求不计入失败, 也不重试
+func isCallerError(ctx context.Context, err error) bool {
+	return err == ErrTCPCanceled || err == context.Canceled || ctx.Err() == context.Canceled
+}
+
+// 按熔断器和重试策略执行fn, idempotent为true时才会重试
+func callWithResilience(ctx context.Context, target string, idempotent bool, fn func() error) (err error) {
+	breaker := getCircuitBreaker(target)
+	policy := getRetryPolicy()
+	attempts := 1
+	if idempotent && policy != nil && policy.MaxAttempts > 1 {
+		attempts = policy.MaxAttempts
+	}
+
+	for i := 0; i < attempts; i++ {
+		if i > 0 {
+			if breaker != nil {
+				breaker.addRetry()
+			}
+			select {
+			case <-time.After(policy.backoff(i)):
+			case <-ctx.Done():
+				return
+			}
+		}
+		if breaker != nil {
+			if err = breaker.allow(); err != nil {
+				return
+			}
+		}
+		err = fn()
+		if breaker != nil {
+			if isCallerError(ctx, err) {
+				breaker.release()
+			} else {
+				breaker.report(err == nil)
+			}
+		}
+		if err == nil || isCallerError(ctx, err) || ctx.Err() != nil {
+			return
+		}
+	}
+	return
+}
@@ -0,0 +1,60 @@
+package net
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// 调用方取消的半开探测请求需释放名额, 状态变化按顺序回调
+func Test_CircuitBreakerHalfOpenRelease(t *testing.T) {
+	var transitions []CircuitState
+	OnCircuitStateChange = func(target string, from, to CircuitState) {
+		transitions = append(transitions, to)
+	}
+	defer func() { OnCircuitStateChange = func(target string, from, to CircuitState) {} }()
+	target := "release.test:1"
+	SetTargetCircuitBreaker(target, &BreakerConfig{FailureThreshold: 1, OpenTimeout: 10 * time.Millisecond})
+	defer SetTargetCircuitBreaker(target, nil)
+
+	failed := errors.New("failed")
+	callWithResilience(context.Background(), target, false, func() error { return failed })
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := callWithResilience(ctx, target, false, func() error { return context.Canceled }); err != context.Canceled {
+		t.Fatalf("canceled probe: %v", err)
+	}
+	if err := callWithResilience(context.Background(), target, false, func() error { return nil }); err != nil {
+		t.Fatalf("probe after cancel: %v", err)
+	}
+	want := []CircuitState{CircuitOpen, CircuitHalfOpen, CircuitClosed}
+	if !reflect.DeepEqual(transitions, want) {
+		t.Errorf("transitions %v, want %v", transitions, want)
+	}
+}
+
+// http 5xx计入熔断失败, 但仍返回响应内容
+func Test_CircuitBreakerHttpServerError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("busy"))
+	}))
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+	SetTargetCircuitBreaker(u.Host, &BreakerConfig{FailureThreshold: 1, OpenTimeout: time.Minute})
+	defer SetTargetCircuitBreaker(u.Host, nil)
+
+	res, err := SendHTTPRequest(server.URL, nil, 1)
+	if err != nil || string(res) != "busy" {
+		t.Fatalf("5xx response %q, %v", res, err)
+	}
+	if _, err = SendHTTPRequest(server.URL, nil, 1); err != ErrCircuitOpen {
+		t.Errorf("request after 5xx: %v", err)
+	}
+}
@@ -0,0 +1,224 @@
+package net
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSendQueueSize = 1024
+	defaultSendMaxBatch  = 64
+)
+
+var (
+	ErrSendQueueFull    = errors.New("send queue full")
+	ErrConnectionClosed = errors.New("connection closed")
+)
+
+// 异步发送配置
+type AsyncWriteConfig struct {
+	// 发送队列长度, 0使用默认值1024
+	QueueSize int
+	// 每次合并发送的最大数据包数, 0使用默认值64
+	MaxBatch int
+	// 队列满时的处理策略: 阻塞发送方, 返回ErrSendQueueFull, 或关闭连接
+	OverflowPolicy QueueFullPolicy
+}
+
+type sendItem struct {
+	msg []byte
+	// 不为0时发送控制帧
+	control ControlFrame
+	done    chan error
+}
+
+// 每个连接一个写goroutine, 将队列中的多个数据包合并为一次系统调用发送
+type asyncWriter struct {
+	c      *TcpConnection
+	config AsyncWriteConfig
+	queue  chan *sendItem
+
+	// 关闭后不再入队, 写goroutine将剩余数据包以ErrConnectionClosed完成
+	mu       sync.RWMutex
+	isClosed bool
+	closed   chan bool
+}
+
+// 开启异步发送, 需在连接开始收发数据前调用; 开启后Send也通过发送队列完成, 保证顺序
+func (c *TcpConnection) EnableAsyncWrite(config AsyncWriteConfig) {
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultSendQueueSize
+	}
+	if config.MaxBatch <= 0 {
+		config.MaxBatch = defaultSendMaxBatch
+	}
+	aw := &asyncWriter{
+		c:      c,
+		config: config,
+		queue:  make(chan *sendItem, config.QueueSize),
+		closed: make(chan bool),
+	}
+	c.asyncWriter.Store(aw)
+	go aw.serve()
+	if c.IsClosed() {
+		aw.stop()
+	}
+}
+
+func (c *TcpConnection) getAsyncWriter() *asyncWriter {
+	aw, _ := c.asyncWriter.Load().(*asyncWriter)
+	return aw
+}
+
+// 异步发送, 返回的channel在数据包发送完成或失败后收到结果;
+// 完成前不能修改msg, 未开启异步发送时同步发送后返回
+func (c *TcpConnection) SendAsync(msg []byte) <-chan error {
+	aw := c.getAsyncWriter()
+	if aw == nil {
+		done := make(chan error, 1)
+		_, err := c.Send(msg)
+		done <- err
+		return done
+	}
+	return aw.send(msg)
+}
+
+// 发送队列中等待的数据包数
+func (c *TcpConnection) SendQueueLen() int {
+	if aw := c.getAsyncWriter(); aw != nil {
+		return len(aw.queue)
+	}
+	return 0
+}
+
+func (aw *asyncWriter) send(msg []byte) <-chan error {
+	return aw.sendItem(&sendItem{msg: msg, done: make(chan error, 1)})
+}
+
+func (aw *asyncWriter) sendControl(frame ControlFrame) <-chan error {
+	return aw.sendItem(&sendItem{control: frame, done: make(chan error, 1)})
+}
+
+func (aw *asyncWriter) sendItem(item *sendItem) <-chan error {
+	if aw.enqueue(item) {
+		return item.done
+	}
+	item.done <- ErrSendQueueFull
+	if aw.config.OverflowPolicy == QueueFullClose {
+		aw.c.Close()
+	}
+	return item.done
+}
+
+// 入队, 队列满且策略不是阻塞时返回false
+func (aw *asyncWriter) enqueue(item *sendItem) bool {
+	aw.mu.RLock()
+	defer aw.mu.RUnlock()
+	if aw.isClosed {
+		item.done <- ErrConnectionClosed
+		return true
+	}
+	select {
+	case aw.queue <- item:
+		return true
+	default:
+	}
+	if aw.config.OverflowPolicy != QueueFullBlock {
+		return false
+	}
+	// 写goroutine在stop之前会一直消费队列, 这里不会永久阻塞
+	aw.queue <- item
+	return true
+}
+
+func (aw *asyncWriter) stop() {
+	aw.mu.Lock()
+	defer aw.mu.Unlock()
+	if !aw.isClosed {
+		aw.isClosed = true
+		close(aw.closed)
+	}
+}
+
+func (aw *asyncWriter) serve() {
+	batch := make([]*sendItem, 0, aw.config.MaxBatch)
+	for {
+		select {
+		case item := <-aw.queue:
+			batch = append(batch[:0], item)
+		case <-aw.closed:
+			aw.drain()
+			return
+		}
+	fill:
+		for len(batch) < aw.config.MaxBatch {
+			select {
+			case item := <-aw.queue:
+				batch = append(batch, item)
+			default:
+				break fill
+			}
+		}
+		aw.write(batch)
+		for i := range batch {
+			batch[i] = nil
+		}
+	}
+}
+
+func (aw *asyncWriter) write(batch []*sendItem) {
+	c := aw.c
+	errs := make([]error, len(batch))
+	c.sendMutex.Lock()
+	for i, item := range batch {
+		if item.control != 0 {
+			errs[i] = c.writer.encodeControl(item.control)
+		} else {
+			_, errs[i] = c.writer.encode(item.msg)
+		}
+	}
+	err := c.writer.flush()
+	c.sendMutex.Unlock()
+
+	for i, item := range batch {
+		if errs[i] == nil {
+			errs[i] = err
+		}
+		if errs[i] == nil && item.control == 0 {
+			// 用于嵌入发包成功的逻辑，用于调试
+			c.hooks.onDataOut(c.conn, item.msg)
+		}
+		item.done <- errs[i]
+	}
+	if err != nil {
+		// Close会等待入队中的发送方, 不能在写goroutine中同步调用
+		go c.Close()
+	}
+}
+
+func (aw *asyncWriter) drain() {
+	for {
+		select {
+		case item := <-aw.queue:
+			item.done <- ErrConnectionClosed
+		default:
+			return
+		}
+	}
+}
+
+// 等待异步发送结果, timeOut为0时不超时
+func waitSendResult(done <-chan error, timeOut time.Duration) error {
+	if timeOut <= 0 {
+		return <-done
+	}
+	timer := time.NewTimer(timeOut)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return ErrTCPTimeout
+	}
+}
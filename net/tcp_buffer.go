@@ -0,0 +1,77 @@
+package net
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// 缓冲池按2的幂分级, 512B ~ 16M, 超过最大级别的直接分配, 不放回缓冲池
+const (
+	minBufferShift = 9
+	maxBufferShift = 24
+)
+
+var bufferPools [maxBufferShift - minBufferShift + 1]sync.Pool
+
+// 从缓冲池分配的数据包, 使用完后调用Release归还, 归还后不能再访问Bytes返回的内存
+type Buffer struct {
+	buf      []byte
+	n        int
+	class    int
+	released int32
+}
+
+// 分配长度为n的缓冲
+func GetBuffer(n int) *Buffer {
+	class := bufferClass(n)
+	if class < 0 {
+		return &Buffer{buf: make([]byte, n), n: n, class: -1}
+	}
+	if b, ok := bufferPools[class].Get().(*Buffer); ok {
+		b.n = n
+		atomic.StoreInt32(&b.released, 0)
+		return b
+	}
+	return &Buffer{buf: make([]byte, 1<<uint(class+minBufferShift)), n: n, class: class}
+}
+
+// 从r中读取n字节到缓冲池内存
+func readBuffer(r io.Reader, n int) (b *Buffer, err error) {
+	b = GetBuffer(n)
+	if _, err = io.ReadFull(r, b.Bytes()); err != nil {
+		b.Release()
+		return nil, err
+	}
+	return
+}
+
+// 包装普通切片, Release不做任何事
+func wrapBuffer(p []byte) *Buffer {
+	return &Buffer{buf: p, n: len(p), class: -1}
+}
+
+func bufferClass(n int) int {
+	for shift := minBufferShift; shift <= maxBufferShift; shift++ {
+		if n <= 1<<uint(shift) {
+			return shift - minBufferShift
+		}
+	}
+	return -1
+}
+
+func (b *Buffer) Bytes() []byte {
+	return b.buf[:b.n]
+}
+
+func (b *Buffer) Len() int {
+	return b.n
+}
+
+// 归还缓冲池, 重复调用只归还一次
+func (b *Buffer) Release() {
+	if b.class < 0 || !atomic.CompareAndSwapInt32(&b.released, 0, 1) {
+		return
+	}
+	bufferPools[b.class].Put(b)
+}
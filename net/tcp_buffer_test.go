@@ -0,0 +1,98 @@
+package net
+
+import (
+	"bytes"
+	"testing"
+)
+
+func Test_BufferPool(t *testing.T) {
+	b := GetBuffer(100)
+	if b.Len() != 100 || len(b.Bytes()) != 100 || cap(b.buf) != 512 {
+		t.Fatalf("buffer size error: len %d cap %d", b.Len(), cap(b.buf))
+	}
+	b.Release()
+	b.Release()
+	if b := GetBuffer(1 << 25); b.class >= 0 || b.Len() != 1<<25 {
+		t.Error("oversize buffer should not be pooled")
+	}
+	if c := bufferClass(513); c != 1 {
+		t.Errorf("bufferClass(513) = %d, want 1", c)
+	}
+}
+
+func Test_ReadBuffer(t *testing.T) {
+	codecs := map[string]Codec{
+		"uint32be": Uint32BECodec,
+		"varint":   VarintCodec,
+		"line":     LineCodec,
+		"fixed":    NewFixedLengthCodec(5),
+	}
+	for name, codec := range codecs {
+		var buf bytes.Buffer
+		codec.WriteFrame(&buf, []byte("hello"))
+		codec.WriteFrame(&buf, []byte("world"))
+		r := newReader(&buf, codec)
+		for _, want := range []string{"hello", "world"} {
+			b, err := r.readBuffer()
+			if err != nil {
+				t.Fatalf("%s read buffer error: %v", name, err)
+			}
+			if string(b.Bytes()) != want {
+				t.Errorf("%s read buffer %q, want %q", name, b.Bytes(), want)
+			}
+			b.Release()
+		}
+	}
+}
+
+// 循环返回同一段数据
+type repeatReader struct {
+	data []byte
+	off  int
+}
+
+func (r *repeatReader) Read(p []byte) (n int, err error) {
+	for n < len(p) {
+		m := copy(p[n:], r.data[r.off:])
+		n += m
+		r.off = (r.off + m) % len(r.data)
+	}
+	return
+}
+
+func newBenchReader(size int) *reader {
+	var buf bytes.Buffer
+	DefaultCodec.WriteFrame(&buf, make([]byte, size))
+	return newReader(&repeatReader{data: buf.Bytes()}, DefaultCodec)
+}
+
+func benchmarkReadPacket(b *testing.B, size int) {
+	r := newBenchReader(size)
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := r.readPacket(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func benchmarkReadBuffer(b *testing.B, size int) {
+	r := newBenchReader(size)
+	b.ReportAllocs()
+	b.SetBytes(int64(size))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf, err := r.readBuffer()
+		if err != nil {
+			b.Fatal(err)
+		}
+		buf.Release()
+	}
+}
+
+func Benchmark_ReadPacket128(b *testing.B) { benchmarkReadPacket(b, 128) }
+func Benchmark_ReadBuffer128(b *testing.B) { benchmarkReadBuffer(b, 128) }
+func Benchmark_ReadPacket64K(b *testing.B) { benchmarkReadPacket(b, 64*1024) }
+func Benchmark_ReadBuffer64K(b *testing.B) { benchmarkReadBuffer(b, 64*1024) }
@@ -1,9 +1,14 @@
 package net
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
 	"net"
 	"strconv"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/xuhn/optimusprime/log"
@@ -14,225 +19,246 @@ const (
 	defaultConnectTimeout = 3 * time.Second
 )
 
+var (
+	ErrTCPTimeout      = errors.New("tcp request timeout")
+	ErrTCPCanceled     = errors.New("tcp request canceled")
+	ErrTCPRemoteClosed = errors.New("tcp connection closed by remote")
+)
+
 type clientTcpConnection struct {
 	isOldConn bool
 	tcpConn   *TcpConnection
+	createdAt time.Time
+	idleAt    time.Time
+	// 所属连接池的key, 见clientPoolKey
+	poolKey string
 }
 
 var (
-	clientTcpConnectionPoolMu sync.Mutex
-	clientTcpConnectionPool       = make(map[string][]*clientTcpConnection)
-	connectionLimit           int = 1000
+	// 客户端数据包编解码
+	clientCodecMu    sync.RWMutex
+	clientCodec      Codec = DefaultCodec
+	clientAddrCodecs       = make(map[string]Codec)
+
+	// 客户端最大数据包长度
+	clientMaxFrameSize int = defaultMaxFrameSize
 )
 
 func setClientConnectionLimit(limit int) {
-	connectionLimit = limit
-}
-
-func newClientTcpConnection(s_peer_addr string, i_peer_port int, timeOut uint32) (c *clientTcpConnection, err error) {
-	remote_addr := s_peer_addr + ":" + strconv.Itoa(i_peer_port)
-	clientTcpConnectionPoolMu.Lock()
-	connections, ok := clientTcpConnectionPool[remote_addr]
-	if ok {
-		connNum := len(connections)
-		if connNum > 0 {
-			c = connections[0]
-			copy(connections, connections[1:])
-			connections = connections[:connNum-1]
-			clientTcpConnectionPool[remote_addr] = connections
-			log.DEBUGF("get client connection [ %s -> %s ] from pool", c.tcpConn.conn.LocalAddr(), c.tcpConn.conn.RemoteAddr())
-			clientTcpConnectionPoolMu.Unlock()
-			return
-		}
+	clientPool.setMaxIdle(limit)
+}
+
+func setClientMaxFrameSize(size int) {
+	clientCodecMu.Lock()
+	clientMaxFrameSize = normalizeMaxFrameSize(size)
+	clientCodecMu.Unlock()
+}
+
+func getClientMaxFrameSize() int {
+	clientCodecMu.RLock()
+	defer clientCodecMu.RUnlock()
+	return clientMaxFrameSize
+}
+
+func setClientCodec(codec Codec) {
+	if codec == nil {
+		codec = DefaultCodec
 	}
+	clientCodecMu.Lock()
+	clientCodec = codec
+	clientCodecMu.Unlock()
+}
 
-	clientTcpConnectionPoolMu.Unlock()
-	return connectServer("tcp", remote_addr, time.Duration(timeOut)*time.Second)
+func setClientAddrCodec(s_peer_addr string, i_peer_port int, codec Codec) {
+	remote_addr := clientRemoteAddr(s_peer_addr, i_peer_port)
+	clientCodecMu.Lock()
+	if codec == nil {
+		delete(clientAddrCodecs, remote_addr)
+	} else {
+		clientAddrCodecs[remote_addr] = codec
+	}
+	clientCodecMu.Unlock()
+	// 已建立的连接使用旧的编解码, 需要关闭
+	closeClientTcpConnection(remote_addr)
 }
 
-func connectServer(network, address string, timeout time.Duration) (c *clientTcpConnection, err error) {
-	if timeout > defaultConnectTimeout {
-		timeout = defaultConnectTimeout
+func getClientCodec(remote_addr string) Codec {
+	clientCodecMu.RLock()
+	defer clientCodecMu.RUnlock()
+	if codec, ok := clientAddrCodecs[remote_addr]; ok {
+		return codec
 	}
-	conn, err := net.DialTimeout(network, address, timeout)
+	return clientCodec
+}
+
+func clientRemoteAddr(s_peer_addr string, i_peer_port int) string {
+	if isUnixAddr(s_peer_addr) {
+		return s_peer_addr
+	}
+	return s_peer_addr + ":" + strconv.Itoa(i_peer_port)
+}
+
+func connectServer(ctx context.Context, network, address string) (c *clientTcpConnection, err error) {
+	// 建立连接的超时不超过defaultConnectTimeout, ctx的deadline更早时以ctx为准
+	dialer := &net.Dialer{Timeout: defaultConnectTimeout}
+	dialNetwork, dialAddress := dialAddr(network, address)
+	conn, err := dialer.DialContext(ctx, dialNetwork, dialAddress)
 	if err != nil {
 		return
 	}
 	log.DEBUGF("new client connection [ %s -> %s ]", conn.LocalAddr(), conn.RemoteAddr())
-	tcpConn := newTcpConnection(conn)
-	err = tcpConn.SetKeepAlive(defaultKeepAlivePeriod)
+	var tcpConn *TcpConnection
+	if conf := clientTLSConfig(ctx, address); conf != nil {
+		tlsConn := tls.Client(conn, conf)
+		deadline, _ := ctx.Deadline()
+		if err = tlsHandshake(tlsConn, deadline); err != nil {
+			conn.Close()
+			return
+		}
+		tcpConn = newTcpConnection(tlsConn, getClientConnCodec(address))
+		tcpConn.rawConn = conn
+	} else {
+		tcpConn = newTcpConnection(conn, getClientConnCodec(address))
+	}
+	tcpConn.SetMaxFrameSize(getClientMaxFrameSize())
+	startClientHeartbeat(tcpConn, false)
+	if err = tcpConn.SetKeepAlive(defaultKeepAlivePeriod); err != nil {
+		tcpConn.Close()
+		return
+	}
 	c = &clientTcpConnection{
-		tcpConn: tcpConn,
+		tcpConn:   tcpConn,
+		createdAt: time.Now(),
 	}
 	return
 }
 
-func freeClientTcpConnection(s_peer_addr string, i_peer_port int, c *clientTcpConnection) {
-	remote_addr := s_peer_addr + ":" + strconv.Itoa(i_peer_port)
-	clientTcpConnectionPoolMu.Lock()
-	defer clientTcpConnectionPoolMu.Unlock()
-	connections, ok := clientTcpConnectionPool[remote_addr]
-	if !ok {
-		connections = make([]*clientTcpConnection, 0)
-	}
-	connNum := len(connections)
-	if connNum >= connectionLimit {
-		c.tcpConn.Close()
-	} else {
-		c.isOldConn = true
-		connections = append(connections, c)
-		clientTcpConnectionPool[remote_addr] = connections
-	}
+func closeClientTcpConnection(remote_addr string) {
+	clientPool.closeIdle(remote_addr)
 }
 
-func closeClientTcpConnection(s_peer_addr string, i_peer_port int) {
-	remote_addr := s_peer_addr + ":" + strconv.Itoa(i_peer_port)
-	clientTcpConnectionPoolMu.Lock()
-	defer clientTcpConnectionPoolMu.Unlock()
-	connections, ok := clientTcpConnectionPool[remote_addr]
-	if ok {
-		for _, v := range connections {
-			v.tcpConn.Close()
-		}
-		delete(clientTcpConnectionPool, remote_addr)
+// 发送请求, 按needResponse决定是否等待回包
+// ctx取消或超时后立即中断连接上的读写, 返回ErrTCPCanceled或ErrTCPTimeout
+func (c *clientTcpConnection) roundTrip(ctx context.Context, req []byte, needResponse bool) (res []byte, err error) {
+	conn := c.tcpConn.conn
+	// 没有deadline时清除连接池中旧连接上的deadline
+	deadline, _ := ctx.Deadline()
+	if err = conn.SetDeadline(deadline); err != nil {
+		return
 	}
-}
-
-func sendClientRequest(s_peer_addr string, i_peer_port int, req []byte, timeOut uint32) ([]byte, error) {
-	var connection *clientTcpConnection
-	var res []byte
-	var err error
-	// 可能连接失效,重试
-	for i := 0; i < maxBadConnRetries; i++ {
-		connection, err = newClientTcpConnection(s_peer_addr, i_peer_port, timeOut)
-		if err != nil {
-			break
-		}
-		if err = connection.tcpConn.SetDeadline(time.Duration(timeOut) * time.Second); err != nil {
-			if connection.isOldConn {
-				closeClientTcpConnection(s_peer_addr, i_peer_port)
-				continue
-			}
-			break
-		}
-
-		//发送
-		writeErrChan := make(chan error)
+	if ctx.Done() != nil {
+		finished := make(chan bool)
+		watcherDone := make(chan bool)
+		fired := false
 		go func() {
-			_, e := connection.tcpConn.Send(req)
-			writeErrChan <- e
-		}()
-
-		select {
-		case err = <-writeErrChan:
-			//快速返回本地错误
-			if err != nil {
-				if connection.isOldConn {
-					closeClientTcpConnection(s_peer_addr, i_peer_port)
-					continue
-				}
-				break
-			}
-		case <-time.After(50 * time.Millisecond):
-			err = <-writeErrChan
-		}
-
-		if err == nil {
-			readErrChan := make(chan error)
-			go func() {
-				tmp_res, err := connection.tcpConn.Receive()
-				res = make([]byte, 0, len(tmp_res))
-				res = append(res, tmp_res...)
-				//xflog.DEBUG("checking", len(res), res)
-				readErrChan <- err
-			}()
-
+			defer close(watcherDone)
 			select {
-			case err = <-readErrChan:
-				//快速返回本地错误
-				if err != nil {
-					if connection.isOldConn {
-						closeClientTcpConnection(s_peer_addr, i_peer_port)
-						continue
-					}
-					break
-				}
-			case <-time.After(50 * time.Millisecond):
-				err = <-readErrChan
+			case <-ctx.Done():
+				// 设置过期的deadline, 唤醒阻塞中的读写
+				fired = true
+				conn.SetDeadline(time.Unix(1, 0))
+			case <-finished:
 			}
-			break
-		}
-		break
+		}()
+		// 等待watcher退出后再返回, 避免连接放回连接池后才被设置过期的deadline
+		defer func() {
+			close(finished)
+			<-watcherDone
+			if fired && err == nil {
+				// 请求已完成, 清除过期的deadline; 失败时返回错误, 连接不再放回连接池
+				err = conn.SetDeadline(time.Time{})
+			}
+		}()
 	}
 
-	//放回连接池
-	if err == nil && connection != nil {
-		freeClientTcpConnection(s_peer_addr, i_peer_port, connection)
-		return res, err
+	if _, err = c.tcpConn.Send(req); err != nil {
+		return
 	}
-	// 关闭连接
-	if err != nil && connection != nil {
-		connection.tcpConn.Close()
+	if needResponse {
+		res, err = c.tcpConn.Receive()
 	}
-	return res, err
+	return
 }
 
-func sendClientRequestNoResponse(s_peer_addr string, i_peer_port int, req []byte, timeOut uint32) (err error) {
+// 按熔断和重试策略发送请求
+func sendClientRequestContext(ctx context.Context, remote_addr string, req []byte, needResponse bool) (res []byte, err error) {
+	err = callWithResilience(ctx, remote_addr, isIdempotent(ctx), func() (e error) {
+		res, e = doClientRequest(ctx, remote_addr, req, needResponse)
+		return
+	})
+	return
+}
+
+func doClientRequest(ctx context.Context, remote_addr string, req []byte, needResponse bool) (res []byte, err error) {
+	// 多路复用模式; 多路复用连接按地址共享, ctx指定了TLS配置时不使用
+	if g := getClientMultiplex(remote_addr); g != nil && clientTLSFromContext(ctx) == nil {
+		return sendMuxRequest(ctx, g, req, needResponse)
+	}
 	var connection *clientTcpConnection
 	// 可能连接失效,重试
 	for i := 0; i < maxBadConnRetries; i++ {
-		connection, err = newClientTcpConnection(s_peer_addr, i_peer_port, timeOut)
+		connection, err = clientPool.get(ctx, remote_addr)
 		if err != nil {
+			return nil, clientRequestError(ctx, err)
+		}
+		res, err = connection.roundTrip(ctx, req, needResponse)
+		if err == nil {
+			//放回连接池
+			clientPool.put(remote_addr, connection, true)
 			return
 		}
-		if err = connection.tcpConn.SetDeadline(time.Duration(timeOut) * time.Second); err != nil {
-			if connection.isOldConn {
-				closeClientTcpConnection(s_peer_addr, i_peer_port)
-				continue
-			}
-			break
+		// 关闭连接
+		clientPool.put(remote_addr, connection, false)
+		err = clientRequestError(ctx, err)
+		// 连接池中的连接可能已被对端关闭, 清空连接池后重试
+		if connection.isOldConn && err != ErrTCPTimeout && err != ErrTCPCanceled {
+			closeClientTcpConnection(remote_addr)
+			continue
 		}
-
-		//发送
-		writeErrChan := make(chan error)
-		go func() {
-			_, e := connection.tcpConn.Send(req)
-			writeErrChan <- e
-		}()
-
-		select {
-		case err = <-writeErrChan:
-			//快速返回本地错误
-			if err != nil {
-				if connection.isOldConn {
-					closeClientTcpConnection(s_peer_addr, i_peer_port)
-					continue
-				}
-				break
-			}
-		case <-time.After(50 * time.Millisecond):
-			err = <-writeErrChan
-		}
-		break
+		return
 	}
+	return
+}
 
-	//放回连接池
-	if err == nil && connection != nil {
-		freeClientTcpConnection(s_peer_addr, i_peer_port, connection)
-		return
+// 将底层错误转换为可区分的超时/取消/对端关闭错误
+func clientRequestError(ctx context.Context, err error) error {
+	switch ctx.Err() {
+	case context.Canceled:
+		return ErrTCPCanceled
+	case context.DeadlineExceeded:
+		return ErrTCPTimeout
 	}
-	// 关闭连接
-	if err != nil && connection != nil {
-		connection.tcpConn.Close()
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return ErrTCPTimeout
 	}
-	return
+	if err == io.EOF || err == io.ErrUnexpectedEOF ||
+		errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE) {
+		return ErrTCPRemoteClosed
+	}
+	return err
 }
 
-func LenClientTcpConnections(s_peer_addr string, i_peer_port int) (plen int) {
-	remote_addr := s_peer_addr + ":" + strconv.Itoa(i_peer_port)
-	connections, ok := clientTcpConnectionPool[remote_addr]
-	if ok {
-		plen = len(connections)
+// timeOut为0时不超时
+func timeoutContext(timeOut uint32) (context.Context, context.CancelFunc) {
+	if timeOut == 0 {
+		return context.WithCancel(context.Background())
 	}
+	return context.WithTimeout(context.Background(), time.Duration(timeOut)*time.Second)
+}
+
+func sendClientRequest(s_peer_addr string, i_peer_port int, req []byte, timeOut uint32) ([]byte, error) {
+	ctx, cancel := timeoutContext(timeOut)
+	defer cancel()
+	return sendClientRequestContext(ctx, clientRemoteAddr(s_peer_addr, i_peer_port), req, true)
+}
+
+func sendClientRequestNoResponse(s_peer_addr string, i_peer_port int, req []byte, timeOut uint32) (err error) {
+	ctx, cancel := timeoutContext(timeOut)
+	defer cancel()
+	_, err = sendClientRequestContext(ctx, clientRemoteAddr(s_peer_addr, i_peer_port), req, false)
 	return
 }
+
+func LenClientTcpConnections(s_peer_addr string, i_peer_port int) (plen int) {
+	return clientPool.lenIdle(clientRemoteAddr(s_peer_addr, i_peer_port))
+}
@@ -0,0 +1,296 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xuhn/optimusprime/log"
+)
+
+// 多路复用模式下每个数据包前4字节为大端请求序号, 服务端回包需原样带回序号
+const muxSeqSize = 4
+
+var (
+	ErrMuxFrame  = errors.New("multiplex frame too short")
+	ErrMuxClosed = errors.New("multiplex group closed")
+)
+
+type muxResult struct {
+	res []byte
+	err error
+}
+
+// 多路复用连接, 多个请求共享一个连接, 按序号分发回包
+type muxClientConnection struct {
+	tcpConn *TcpConnection
+	writeMu sync.Mutex
+
+	seq       uint32
+	pendingMu sync.Mutex
+	pending   map[uint32]chan muxResult
+
+	closed   chan bool
+	closeErr error
+}
+
+// 同一地址的一组多路复用连接, 轮询使用
+type muxClientGroup struct {
+	mu          sync.Mutex
+	remote_addr string
+	conns       []*muxClientConnection
+	// 正在建立的连接, 同一位置只有一个请求建立连接, 其余请求等待结果
+	dialing []*muxDial
+	next    uint32
+	closed  bool
+}
+
+type muxDial struct {
+	done chan struct{}
+	conn *muxClientConnection
+	err  error
+}
+
+var (
+	muxClientGroupsMu sync.Mutex
+	muxClientGroups   = make(map[string]*muxClientGroup)
+)
+
+func setClientMultiplex(remote_addr string, connNum int) {
+	muxClientGroupsMu.Lock()
+	old, ok := muxClientGroups[remote_addr]
+	if connNum <= 0 {
+		delete(muxClientGroups, remote_addr)
+	} else {
+		muxClientGroups[remote_addr] = &muxClientGroup{
+			remote_addr: remote_addr,
+			conns:       make([]*muxClientConnection, connNum),
+			dialing:     make([]*muxDial, connNum),
+		}
+	}
+	muxClientGroupsMu.Unlock()
+	if ok {
+		old.close()
+	}
+}
+
+func getClientMultiplex(remote_addr string) *muxClientGroup {
+	muxClientGroupsMu.Lock()
+	defer muxClientGroupsMu.Unlock()
+	return muxClientGroups[remote_addr]
+}
+
+// 获取一个连接, 连接不可用时在锁外重新建立, 避免阻塞其他位置的请求
+func (g *muxClientGroup) get(ctx context.Context) (c *muxClientConnection, err error) {
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return nil, ErrMuxClosed
+	}
+	i := int(g.next % uint32(len(g.conns)))
+	g.next++
+	if c = g.conns[i]; c != nil && !c.isClosed() {
+		g.mu.Unlock()
+		return
+	}
+	if d := g.dialing[i]; d != nil {
+		g.mu.Unlock()
+		select {
+		case <-d.done:
+			return d.conn, d.err
+		case <-ctx.Done():
+			return nil, clientRequestError(ctx, ctx.Err())
+		}
+	}
+	d := &muxDial{done: make(chan struct{})}
+	g.dialing[i] = d
+	g.mu.Unlock()
+	defer close(d.done)
+
+	cc, err := connectServer(ctx, "tcp", g.remote_addr)
+	if err == nil {
+		startClientHeartbeat(cc.tcpConn, true)
+		c = newMuxClientConnection(cc.tcpConn)
+	}
+	g.mu.Lock()
+	g.dialing[i] = nil
+	closed := g.closed
+	if c != nil && !closed {
+		g.conns[i] = c
+	}
+	g.mu.Unlock()
+	if c != nil && closed {
+		// 建立连接期间分组已关闭
+		c.tcpConn.Close()
+		c, err = nil, ErrMuxClosed
+	}
+	d.conn, d.err = c, err
+	return
+}
+
+func (g *muxClientGroup) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+	for i, c := range g.conns {
+		if c != nil {
+			c.tcpConn.Close()
+		}
+		g.conns[i] = nil
+	}
+}
+
+func newMuxClientConnection(tcpConn *TcpConnection) *muxClientConnection {
+	c := &muxClientConnection{
+		tcpConn: tcpConn,
+		pending: make(map[uint32]chan muxResult),
+		closed:  make(chan bool),
+	}
+	go c.readLoop()
+	return c
+}
+
+func (c *muxClientConnection) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// 读取回包并按序号分发给等待的请求
+func (c *muxClientConnection) readLoop() {
+	for {
+		msg, err := c.tcpConn.Receive()
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		if len(msg) < muxSeqSize {
+			c.tcpConn.Close()
+			c.fail(ErrMuxFrame)
+			return
+		}
+		seq := binary.BigEndian.Uint32(msg[:muxSeqSize])
+		c.pendingMu.Lock()
+		ch, ok := c.pending[seq]
+		delete(c.pending, seq)
+		c.pendingMu.Unlock()
+		if !ok {
+			// 已超时或不需要回包的请求
+			log.DEBUGF("drop multiplex response seq(%d) from %s", seq, c.tcpConn.conn.RemoteAddr())
+			continue
+		}
+		ch <- muxResult{res: msg[muxSeqSize:]}
+	}
+}
+
+// 连接断开, 通知所有等待中的请求; 只有第一次调用生效
+func (c *muxClientConnection) fail(err error) {
+	c.pendingMu.Lock()
+	if c.isClosed() {
+		c.pendingMu.Unlock()
+		return
+	}
+	c.closeErr = err
+	pending := c.pending
+	c.pending = make(map[uint32]chan muxResult)
+	close(c.closed)
+	c.pendingMu.Unlock()
+	for _, ch := range pending {
+		ch <- muxResult{err: err}
+	}
+}
+
+func (c *muxClientConnection) roundTrip(ctx context.Context, req []byte, needResponse bool) (res []byte, err error) {
+	seq := atomic.AddUint32(&c.seq, 1)
+	var ch chan muxResult
+	if needResponse {
+		ch = make(chan muxResult, 1)
+		c.pendingMu.Lock()
+		if c.isClosed() {
+			err = c.closeErr
+			c.pendingMu.Unlock()
+			return
+		}
+		c.pending[seq] = ch
+		c.pendingMu.Unlock()
+	}
+
+	frame := make([]byte, muxSeqSize+len(req))
+	binary.BigEndian.PutUint32(frame, seq)
+	copy(frame[muxSeqSize:], req)
+	if err = c.write(ctx, frame); err != nil {
+		// 连接已被write关闭, 其他等待中的请求由fail通知
+		c.removePending(seq)
+		return
+	}
+	if !needResponse {
+		return
+	}
+
+	select {
+	case result := <-ch:
+		return result.res, result.err
+	case <-ctx.Done():
+		c.removePending(seq)
+		return nil, ctx.Err()
+	}
+}
+
+// 写操作独占连接, 写超时取ctx的deadline
+// 写失败时可能已写出部分数据, 连接上的数据流已不完整, 关闭连接并通知所有请求, 下次get时重连
+func (c *muxClientConnection) write(ctx context.Context, frame []byte) (err error) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultConnectTimeout)
+	}
+	if err = c.tcpConn.conn.SetWriteDeadline(deadline); err == nil {
+		_, err = c.tcpConn.Send(frame)
+	}
+	if err != nil {
+		c.tcpConn.Close()
+		c.fail(err)
+	}
+	return
+}
+
+func (c *muxClientConnection) removePending(seq uint32) {
+	c.pendingMu.Lock()
+	delete(c.pending, seq)
+	c.pendingMu.Unlock()
+}
+
+func sendMuxRequest(ctx context.Context, g *muxClientGroup, req []byte, needResponse bool) (res []byte, err error) {
+	c, err := g.get(ctx)
+	if err != nil {
+		return nil, clientRequestError(ctx, err)
+	}
+	if res, err = c.roundTrip(ctx, req, needResponse); err != nil {
+		err = clientRequestError(ctx, err)
+	}
+	return
+}
+
+// 解析多路复用请求, 返回请求序号和请求内容
+func parseMuxRequest(msg []byte) (seq uint32, req []byte, err error) {
+	if len(msg) < muxSeqSize {
+		return 0, nil, ErrMuxFrame
+	}
+	return binary.BigEndian.Uint32(msg[:muxSeqSize]), msg[muxSeqSize:], nil
+}
+
+// 多路复用回包, 带回请求序号
+func sendMuxResponse(connection *TcpConnection, seq uint32, res []byte) (err error) {
+	frame := make([]byte, muxSeqSize+len(res))
+	binary.BigEndian.PutUint32(frame, seq)
+	copy(frame[muxSeqSize:], res)
+	_, err = connection.Send(frame)
+	return
+}
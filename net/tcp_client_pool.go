@@ -0,0 +1,446 @@
+package net
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/xuhn/optimusprime/log"
+)
+
+const (
+	defaultMaxIdleConns = 1000
+	minReapInterval     = time.Second
+)
+
+// TCP客户端连接池配置, 限制均按单个地址计算
+type TCPClientPoolConfig struct {
+	// 最大空闲连接数, 0使用默认值1000, 小于0不保留空闲连接
+	MaxIdle int
+	// 最大打开连接数(空闲+使用中), 0不限制; 达到上限后请求排队等待
+	MaxOpen int
+	// 空闲超时, 0不超时
+	IdleTimeout time.Duration
+	// 连接最长存活时间, 0不限制
+	MaxLifetime time.Duration
+	// 从连接池取出连接时的健康检查, 返回错误则关闭该连接, 为空不检查
+	PingOnBorrow func(conn *TcpConnection) error
+}
+
+// 连接池统计
+type TCPClientPoolStats struct {
+	Open         int           // 打开的连接数
+	Idle         int           // 空闲连接数
+	InUse        int           // 使用中的连接数
+	WaitCount    int64         // 等待连接的总次数
+	WaitDuration time.Duration // 等待连接的总时长
+	DialErrors   int64         // 建立连接失败次数
+	IdleClosed   int64         // 因空闲超时关闭的连接数
+	LifeClosed   int64         // 因超过存活时间关闭的连接数
+	PingFailed   int64         // 健康检查失败关闭的连接数
+}
+
+// 排队等待时得到的连接; c为空表示获得了新建连接的名额
+type poolGrant struct {
+	c *clientTcpConnection
+}
+
+// 单个地址的连接池
+type addrPool struct {
+	key         string
+	remote_addr string
+	idle        []*clientTcpConnection
+	open        int
+	waiters     []chan poolGrant
+	stats       TCPClientPoolStats
+}
+
+type tcpClientPool struct {
+	mu     sync.Mutex
+	config TCPClientPoolConfig
+	addrs  map[string]*addrPool
+
+	reapOnce sync.Once
+}
+
+var clientPool = newTcpClientPool()
+
+func newTcpClientPool() *tcpClientPool {
+	return &tcpClientPool{
+		config: TCPClientPoolConfig{MaxIdle: defaultMaxIdleConns},
+		addrs:  make(map[string]*addrPool),
+	}
+}
+
+func (p *tcpClientPool) setConfig(config TCPClientPoolConfig) {
+	p.mu.Lock()
+	p.config = config
+	p.mu.Unlock()
+}
+
+// 兼容SetTCPClientConnLimit, limit为0时不保留空闲连接
+func (p *tcpClientPool) setMaxIdle(limit int) {
+	if limit <= 0 {
+		limit = -1
+	}
+	p.mu.Lock()
+	p.config.MaxIdle = limit
+	p.mu.Unlock()
+}
+
+func (config TCPClientPoolConfig) maxIdle() int {
+	if config.MaxIdle == 0 {
+		return defaultMaxIdleConns
+	}
+	if config.MaxIdle < 0 {
+		return 0
+	}
+	return config.MaxIdle
+}
+
+// 连接池的key, ctx指定了TLS配置时按tag与地址上的其他连接区分
+func clientPoolKey(ctx context.Context, remote_addr string) string {
+	if t := clientTLSFromContext(ctx); t != nil {
+		return remote_addr + "\x00" + t.tag
+	}
+	return remote_addr
+}
+
+func (p *tcpClientPool) addrPool(key string, remote_addr string) *addrPool {
+	ap, ok := p.addrs[key]
+	if !ok {
+		ap = &addrPool{key: key, remote_addr: remote_addr}
+		p.addrs[key] = ap
+	}
+	return ap
+}
+
+// 连接是否超过空闲时间或存活时间, 需持有锁
+func (p *tcpClientPool) expired(ap *addrPool, c *clientTcpConnection, now time.Time) bool {
+	if p.config.MaxLifetime > 0 && now.Sub(c.createdAt) > p.config.MaxLifetime {
+		ap.stats.LifeClosed++
+		return true
+	}
+	if p.config.IdleTimeout > 0 && now.Sub(c.idleAt) > p.config.IdleTimeout {
+		ap.stats.IdleClosed++
+		return true
+	}
+	return false
+}
+
+// 取出一个未过期的空闲连接, 过期的连接需由调用方在锁外关闭; 需持有锁
+func (p *tcpClientPool) popIdle(ap *addrPool, now time.Time) (c *clientTcpConnection, expired []*clientTcpConnection) {
+	for len(ap.idle) > 0 {
+		n := len(ap.idle)
+		c = ap.idle[n-1]
+		ap.idle[n-1] = nil
+		ap.idle = ap.idle[:n-1]
+		if !p.expired(ap, c, now) {
+			return
+		}
+		ap.open--
+		expired = append(expired, c)
+	}
+	return nil, expired
+}
+
+// 关闭连接, 不能持有锁, 连接的断开钩子可能访问连接池
+func closeClientConns(conns []*clientTcpConnection) {
+	for _, c := range conns {
+		c.tcpConn.Close()
+	}
+}
+
+// 获取连接: 优先使用空闲连接, 未达到MaxOpen时新建, 否则排队等待
+func (p *tcpClientPool) get(ctx context.Context, remote_addr string) (c *clientTcpConnection, err error) {
+	p.startReaper()
+	key := clientPoolKey(ctx, remote_addr)
+	for {
+		p.mu.Lock()
+		ap := p.addrPool(key, remote_addr)
+		c, expired := p.popIdle(ap, time.Now())
+		ping := p.config.PingOnBorrow
+		if c != nil {
+			p.mu.Unlock()
+			closeClientConns(expired)
+			if ping != nil {
+				if e := ping(c.tcpConn); e != nil {
+					log.DEBUGF("client connection [ %s -> %s ] ping fail:%v", c.tcpConn.conn.LocalAddr(), c.tcpConn.conn.RemoteAddr(), e)
+					p.mu.Lock()
+					ap.stats.PingFailed++
+					p.mu.Unlock()
+					p.put(remote_addr, c, false)
+					continue
+				}
+			}
+			log.DEBUGF("get client connection [ %s -> %s ] from pool", c.tcpConn.conn.LocalAddr(), c.tcpConn.conn.RemoteAddr())
+			return c, nil
+		}
+
+		if p.config.MaxOpen <= 0 || ap.open < p.config.MaxOpen {
+			ap.open++
+			p.mu.Unlock()
+			closeClientConns(expired)
+			return p.dial(ctx, ap)
+		}
+
+		// 连接数已满, 排队等待
+		ch := make(chan poolGrant, 1)
+		ap.waiters = append(ap.waiters, ch)
+		ap.stats.WaitCount++
+		p.mu.Unlock()
+		closeClientConns(expired)
+
+		start := time.Now()
+		select {
+		case grant := <-ch:
+			p.addWaitDuration(ap, time.Since(start))
+			if grant.c == nil {
+				return p.dial(ctx, ap)
+			}
+			return grant.c, nil
+		case <-ctx.Done():
+			p.addWaitDuration(ap, time.Since(start))
+			p.mu.Lock()
+			removed := ap.removeWaiter(ch)
+			p.mu.Unlock()
+			if !removed {
+				// 已被分配, 归还
+				grant := <-ch
+				if grant.c != nil {
+					p.put(remote_addr, grant.c, true)
+				} else {
+					p.release(ap)
+				}
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (p *tcpClientPool) addWaitDuration(ap *addrPool, d time.Duration) {
+	p.mu.Lock()
+	ap.stats.WaitDuration += d
+	p.mu.Unlock()
+}
+
+// 新建连接, 调用前已占用名额
+func (p *tcpClientPool) dial(ctx context.Context, ap *addrPool) (c *clientTcpConnection, err error) {
+	if c, err = connectServer(ctx, "tcp", ap.remote_addr); err != nil {
+		p.mu.Lock()
+		ap.stats.DialErrors++
+		p.mu.Unlock()
+		p.release(ap)
+		return nil, err
+	}
+	c.poolKey = ap.key
+	return
+}
+
+// 释放一个名额, 有等待者时转交给等待者新建连接
+func (p *tcpClientPool) release(ap *addrPool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ap.release()
+}
+
+// 需持有锁
+func (ap *addrPool) release() {
+	if ch := ap.popWaiter(); ch != nil {
+		ch <- poolGrant{}
+		return
+	}
+	ap.open--
+}
+
+// 归还连接, reuse为false时关闭连接
+func (p *tcpClientPool) put(remote_addr string, c *clientTcpConnection, reuse bool) {
+	key := c.poolKey
+	if key == "" {
+		key = remote_addr
+	}
+	p.mu.Lock()
+	ap := p.addrPool(key, remote_addr)
+	now := time.Now()
+	c.idleAt = now
+	if reuse && !c.tcpConn.IsClosed() && !p.expired(ap, c, now) {
+		c.isOldConn = true
+		if ch := ap.popWaiter(); ch != nil {
+			ch <- poolGrant{c: c}
+			p.mu.Unlock()
+			return
+		}
+		if len(ap.idle) < p.config.maxIdle() {
+			ap.idle = append(ap.idle, c)
+			p.mu.Unlock()
+			return
+		}
+	}
+	p.mu.Unlock()
+	c.tcpConn.Close()
+	p.release(ap)
+}
+
+// 关闭地址上所有空闲连接, 包括通过ctx指定TLS配置建立的连接
+func (p *tcpClientPool) closeIdle(remote_addr string) {
+	var idle []*clientTcpConnection
+	p.mu.Lock()
+	for _, ap := range p.addrs {
+		if ap.remote_addr == remote_addr {
+			idle = append(idle, ap.takeIdle()...)
+		}
+	}
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.tcpConn.Close()
+	}
+}
+
+// 关闭指定连接池的空闲连接
+func (p *tcpClientPool) closeIdleKey(key string) {
+	var idle []*clientTcpConnection
+	p.mu.Lock()
+	if ap, ok := p.addrs[key]; ok {
+		idle = ap.takeIdle()
+	}
+	p.mu.Unlock()
+	for _, c := range idle {
+		c.tcpConn.Close()
+	}
+}
+
+// 取出所有空闲连接并释放名额, 需持有锁
+func (ap *addrPool) takeIdle() (idle []*clientTcpConnection) {
+	idle = ap.idle
+	ap.idle = nil
+	for range idle {
+		ap.release()
+	}
+	return
+}
+
+// 定时清理超时的空闲连接, 第一次获取连接时启动, 按当前配置的超时时间检查
+func (p *tcpClientPool) startReaper() {
+	p.reapOnce.Do(func() {
+		go p.reap()
+	})
+}
+
+func reapInterval(config TCPClientPoolConfig) (interval time.Duration) {
+	interval = config.IdleTimeout
+	if config.MaxLifetime > 0 && (interval <= 0 || config.MaxLifetime < interval) {
+		interval = config.MaxLifetime
+	}
+	if interval <= 0 {
+		return 0
+	}
+	interval = interval / 2
+	if interval < minReapInterval {
+		interval = minReapInterval
+	}
+	return
+}
+
+func (p *tcpClientPool) reap() {
+	for {
+		p.mu.Lock()
+		interval := reapInterval(p.config)
+		p.mu.Unlock()
+		if interval <= 0 {
+			interval = minReapInterval
+		}
+		time.Sleep(interval)
+		p.reapExpired()
+	}
+}
+
+func (p *tcpClientPool) reapExpired() {
+	var closing []*clientTcpConnection
+	p.mu.Lock()
+	now := time.Now()
+	for _, ap := range p.addrs {
+		alive := ap.idle[:0]
+		for _, c := range ap.idle {
+			if p.expired(ap, c, now) {
+				ap.release()
+				closing = append(closing, c)
+			} else {
+				alive = append(alive, c)
+			}
+		}
+		for i := len(alive); i < len(ap.idle); i++ {
+			ap.idle[i] = nil
+		}
+		ap.idle = alive
+	}
+	p.mu.Unlock()
+	for _, c := range closing {
+		log.DEBUGF("close expired client connection [ %s -> %s ]", c.tcpConn.conn.LocalAddr(), c.tcpConn.conn.RemoteAddr())
+		c.tcpConn.Close()
+	}
+}
+
+func (p *tcpClientPool) lenIdle(remote_addr string) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ap, ok := p.addrs[remote_addr]; ok {
+		return len(ap.idle)
+	}
+	return 0
+}
+
+func (p *tcpClientPool) addrStats(remote_addr string) (stats TCPClientPoolStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if ap, ok := p.addrs[remote_addr]; ok {
+		stats = ap.snapshot()
+	}
+	return
+}
+
+func (p *tcpClientPool) stats() (stats TCPClientPoolStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, ap := range p.addrs {
+		s := ap.snapshot()
+		stats.Open += s.Open
+		stats.Idle += s.Idle
+		stats.InUse += s.InUse
+		stats.WaitCount += s.WaitCount
+		stats.WaitDuration += s.WaitDuration
+		stats.DialErrors += s.DialErrors
+		stats.IdleClosed += s.IdleClosed
+		stats.LifeClosed += s.LifeClosed
+		stats.PingFailed += s.PingFailed
+	}
+	return
+}
+
+func (ap *addrPool) snapshot() (stats TCPClientPoolStats) {
+	stats = ap.stats
+	stats.Open = ap.open
+	stats.Idle = len(ap.idle)
+	stats.InUse = ap.open - len(ap.idle)
+	return
+}
+
+func (ap *addrPool) popWaiter() chan poolGrant {
+	if len(ap.waiters) == 0 {
+		return nil
+	}
+	ch := ap.waiters[0]
+	copy(ap.waiters, ap.waiters[1:])
+	ap.waiters[len(ap.waiters)-1] = nil
+	ap.waiters = ap.waiters[:len(ap.waiters)-1]
+	return ch
+}
+
+func (ap *addrPool) removeWaiter(ch chan poolGrant) bool {
+	for i, w := range ap.waiters {
+		if w == ch {
+			ap.waiters = append(ap.waiters[:i], ap.waiters[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
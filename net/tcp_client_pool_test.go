@@ -0,0 +1,95 @@
+package net
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_ClientPoolMaxIdle(t *testing.T) {
+	cases := []struct {
+		maxIdle int
+		want    int
+	}{
+		{0, defaultMaxIdleConns},
+		{-1, 0},
+		{5, 5},
+	}
+	for _, c := range cases {
+		if got := (TCPClientPoolConfig{MaxIdle: c.maxIdle}).maxIdle(); got != c.want {
+			t.Errorf("MaxIdle %d: got %d, want %d", c.maxIdle, got, c.want)
+		}
+	}
+}
+
+func newPipeClientConnection() *clientTcpConnection {
+	client, server := net.Pipe()
+	server.Close()
+	return &clientTcpConnection{tcpConn: newTcpConnection(client, DefaultCodec), createdAt: time.Now(), idleAt: time.Now()}
+}
+
+// 关闭空闲连接或清理过期连接后, 名额转交给等待MaxOpen的请求
+func Test_ClientPoolReleaseWakesWaiter(t *testing.T) {
+	for _, name := range []string{"closeIdle", "reapExpired"} {
+		p := newTcpClientPool()
+		p.config = TCPClientPoolConfig{MaxOpen: 1, IdleTimeout: time.Millisecond}
+		ap := p.addrPool("addr", "addr")
+		ap.open = 1
+		ap.idle = []*clientTcpConnection{newPipeClientConnection()}
+		ch := make(chan poolGrant, 1)
+		ap.waiters = []chan poolGrant{ch}
+
+		time.Sleep(2 * time.Millisecond)
+		if name == "closeIdle" {
+			p.closeIdle("addr")
+		} else {
+			p.reapExpired()
+		}
+		select {
+		case grant := <-ch:
+			if grant.c != nil {
+				t.Errorf("%s: waiter got a connection, want a dial grant", name)
+			}
+		default:
+			t.Errorf("%s: waiter not woken", name)
+		}
+		if ap.open != 1 || len(ap.waiters) != 0 {
+			t.Errorf("%s: open %d waiters %d", name, ap.open, len(ap.waiters))
+		}
+	}
+}
+
+// 获取连接时过期的空闲连接在锁外关闭, 断开钩子可以访问连接池
+func Test_ClientPoolCloseExpiredOutsideLock(t *testing.T) {
+	p := newTcpClientPool()
+	p.config = TCPClientPoolConfig{IdleTimeout: time.Millisecond}
+	ap := p.addrPool("127.0.0.1:1", "127.0.0.1:1")
+	c := newPipeClientConnection()
+	disconnected := make(chan int, 1)
+	c.tcpConn.hooks = &TCPHooks{OnDisconnect: func(conn *TcpConnection) {
+		disconnected <- p.lenIdle("127.0.0.1:1")
+	}}
+	ap.open = 1
+	ap.idle = []*clientTcpConnection{c}
+	time.Sleep(2 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		p.get(ctx, "127.0.0.1:1")
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("get deadlocked closing an expired connection")
+	}
+	if n := <-disconnected; n != 0 {
+		t.Errorf("idle %d after expired connection closed", n)
+	}
+	if p.stats().IdleClosed != 1 {
+		t.Errorf("IdleClosed %d, want 1", p.stats().IdleClosed)
+	}
+}
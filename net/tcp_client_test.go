@@ -0,0 +1,149 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+)
+
+// 请求完成后ctx立即取消, 连接上不能残留过期的deadline
+func Test_RoundTripCancelAfterFinish(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	serverConn := newTcpConnection(server, DefaultCodec)
+	defer serverConn.Close()
+	go func() {
+		for {
+			msg, err := serverConn.Receive()
+			if err != nil {
+				return
+			}
+			if _, err = serverConn.Send(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	c := &clientTcpConnection{tcpConn: newTcpConnection(client, DefaultCodec)}
+	for i := 0; i < 50; i++ {
+		ctx, cancel := context.WithCancel(context.Background())
+		if _, err := c.roundTrip(ctx, []byte("ping"), true); err != nil {
+			t.Fatalf("round trip %d error: %v", i, err)
+		}
+		cancel()
+		time.Sleep(time.Millisecond)
+		// 不经过roundTrip直接读写, 不会重新设置deadline
+		if _, err := c.tcpConn.Send([]byte("ping")); err != nil {
+			t.Fatalf("send %d after cancel error: %v", i, err)
+		}
+		if _, err := c.tcpConn.Receive(); err != nil {
+			t.Fatalf("receive %d after cancel error: %v", i, err)
+		}
+	}
+}
+
+// 写超时后连接关闭, 等待中的请求收到错误
+func Test_MuxWriteErrorClosesConnection(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := newMuxClientConnection(newTcpConnection(client, DefaultCodec))
+
+	// 对端不读, 写一直阻塞直到超时
+	pendingErr := make(chan error, 1)
+	c.pendingMu.Lock()
+	ch := make(chan muxResult, 1)
+	c.pending[100] = ch
+	c.pendingMu.Unlock()
+	go func() { pendingErr <- (<-ch).err }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := c.roundTrip(ctx, []byte("ping"), true); err == nil {
+		t.Fatal("round trip should fail")
+	}
+	if !c.isClosed() || !c.tcpConn.IsClosed() {
+		t.Fatal("connection not closed after write error")
+	}
+	select {
+	case err := <-pendingErr:
+		if err == nil {
+			t.Fatal("pending request got nil error")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending request not notified")
+	}
+	if _, err := c.roundTrip(context.Background(), []byte("ping"), true); err == nil {
+		t.Fatal("round trip on closed connection should fail")
+	}
+}
+
+// 建立连接在锁外进行, 不阻塞其他位置的请求; 同一位置的请求等待正在建立的连接
+func Test_MuxDialOutsideLock(t *testing.T) {
+	// 接受连接但不进行TLS握手, 建立连接一直阻塞到超时
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	addr := listener.Addr().String()
+	setClientTLSConfig(addr, &tls.Config{InsecureSkipVerify: true}, nil)
+	defer setClientTLSConfig(addr, nil, nil)
+
+	client, server := net.Pipe()
+	defer server.Close()
+	live := newMuxClientConnection(newTcpConnection(client, DefaultCodec))
+	g := &muxClientGroup{
+		remote_addr: addr,
+		conns:       []*muxClientConnection{nil, live},
+		dialing:     make([]*muxDial, 2),
+	}
+	dialErr := make(chan error, 1)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+		_, err := g.get(ctx)
+		dialErr <- err
+	}()
+	for deadline := time.Now().Add(time.Second); ; time.Sleep(time.Millisecond) {
+		g.mu.Lock()
+		dialing := g.dialing[0] != nil
+		g.mu.Unlock()
+		if dialing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("dial not started")
+		}
+	}
+
+	start := time.Now()
+	if c, err := g.get(context.Background()); err != nil || c != live {
+		t.Fatalf("live slot: %v", err)
+	}
+	if d := time.Since(start); d > 100*time.Millisecond {
+		t.Errorf("live slot blocked %v by dial", d)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := g.get(ctx); err != ErrTCPTimeout {
+		t.Errorf("waiting for dial: %v", err)
+	}
+	g.close()
+	if err := <-dialErr; err == nil {
+		t.Error("dial should fail")
+	}
+	if _, err := g.get(context.Background()); err != ErrMuxClosed {
+		t.Errorf("closed group: %v", err)
+	}
+}
@@ -0,0 +1,391 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// 数据包分帧编解码接口
+// ReadFrame 从r中读取一个完整的数据包(不含头部/分隔符), 数据包超过maxSize时返回ErrFrameTooLarge,
+// maxSize小于等于0表示不限制
+// WriteFrame 将数据包加上头部/分隔符写入w, 返回写入的数据包长度;
+// w遵守io.Writer的约定, 不保留写入的切片, WriteFrame返回后可以复用
+type Codec interface {
+	ReadFrame(r *bufio.Reader, maxSize int) (frame []byte, err error)
+	WriteFrame(w io.Writer, frame []byte) (n int, err error)
+}
+
+// 编解码器保证WriteFrame写入w的切片在数据包发送完成前不会被修改时实现该接口,
+// 发送时不拷贝, 头部和数据包直接合并发送(writev); 未实现时写入的数据先拷贝再发送
+// 内置的编解码器每次都分配新的头部, 都实现了该接口
+type NoCopyCodec interface {
+	Codec
+	NoCopyWrite()
+}
+
+// 控制帧, 由编解码层与业务数据包区分, 不会交给业务处理, 用于心跳
+// 支持控制帧的编解码器ReadFrame读到控制帧时返回nil和ControlFrame类型的错误
+type ControlFrame byte
+
+const (
+	ControlPing ControlFrame = 1
+	ControlPong ControlFrame = 2
+)
+
+func (f ControlFrame) Error() string {
+	return fmt.Sprintf("control frame %d", byte(f))
+}
+
+// 支持控制帧的编解码器, 控制帧使用业务数据包不会出现的头部, 不会与数据包混淆
+// 由NewHeartbeatCodec生成, 通信双方需使用相同的编解码器
+type ControlCodec interface {
+	Codec
+	WriteControl(w io.Writer, frame ControlFrame) (err error)
+}
+
+// 为长度头编解码器开启控制帧, 用于心跳; codec已支持控制帧时直接返回
+// 长度头全1(varint为最大的uint64)保留给控制帧, 后跟1字节控制帧类型, 该长度的数据包不能再发送;
+// 不开启时内置编解码器的格式不变. 分隔符和定长编解码器没有可保留的头部, 返回ErrHeartbeatCodec
+func NewHeartbeatCodec(codec Codec) (Codec, error) {
+	switch c := codec.(type) {
+	case ControlCodec:
+		return c, nil
+	case *lengthCodec:
+		cc := *c
+		cc.control = true
+		return &controlLengthCodec{&cc}, nil
+	case *varintCodec:
+		return &controlVarintCodec{&varintCodec{control: true}}, nil
+	}
+	return nil, ErrHeartbeatCodec
+}
+
+// 支持把数据包读入缓冲池内存的编解码器, 未实现时读取后包装为不归还缓冲池的Buffer
+type BufferCodec interface {
+	Codec
+	ReadFrameBuffer(r *bufio.Reader, maxSize int) (frame *Buffer, err error)
+}
+
+var (
+	Uint16BECodec Codec = &lengthCodec{size: 2, order: binary.BigEndian}
+	Uint16LECodec Codec = &lengthCodec{size: 2, order: binary.LittleEndian}
+	Uint32BECodec Codec = &lengthCodec{size: 4, order: binary.BigEndian}
+	Uint32LECodec Codec = &lengthCodec{size: 4, order: binary.LittleEndian}
+	VarintCodec   Codec = &varintCodec{}
+	LineCodec     Codec = NewDelimiterCodec([]byte("\n"))
+
+	// 默认4字节大端长度头, 与历史协议保持一致
+	DefaultCodec Codec = Uint32BECodec
+)
+
+var (
+	ErrFrameLength   = errors.New("frame length out of range")
+	ErrFrameTooLarge = errors.New("frame too large")
+)
+
+// 协议错误, 出现后连接上的数据流已无法继续解析
+func isProtocolError(err error) bool {
+	return err == ErrFrameTooLarge || err == ErrFrameLength
+}
+
+func checkFrameSize(n uint64, maxSize int) error {
+	if maxSize > 0 && n > uint64(maxSize) {
+		return ErrFrameTooLarge
+	}
+	if n > uint64(maxInt) {
+		return ErrFrameLength
+	}
+	return nil
+}
+
+// ===================================================================================
+// 定长头部, 头部为数据包长度; 开启控制帧时全1的长度保留给控制帧
+type lengthCodec struct {
+	size    int
+	order   binary.ByteOrder
+	control bool
+}
+
+// 开启控制帧的长度头编解码器
+type controlLengthCodec struct {
+	*lengthCodec
+}
+
+func (c *lengthCodec) ReadFrame(r *bufio.Reader, maxSize int) (frame []byte, err error) {
+	n, err := c.readLength(r, maxSize)
+	if err != nil {
+		return
+	}
+	frame = make([]byte, n)
+	_, err = io.ReadFull(r, frame)
+	return
+}
+
+func (c *lengthCodec) ReadFrameBuffer(r *bufio.Reader, maxSize int) (frame *Buffer, err error) {
+	n, err := c.readLength(r, maxSize)
+	if err != nil {
+		return
+	}
+	return readBuffer(r, n)
+}
+
+func (c *lengthCodec) readLength(r *bufio.Reader, maxSize int) (n int, err error) {
+	// 直接读取bufio内部缓冲, 避免为头部分配内存
+	head, err := r.Peek(c.size)
+	if err != nil {
+		if len(head) > 0 && err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	var size uint64
+	switch c.size {
+	case 2:
+		size = uint64(c.order.Uint16(head))
+	case 4:
+		size = uint64(c.order.Uint32(head))
+	}
+	r.Discard(c.size)
+	if c.control && size == c.controlLength() {
+		return 0, readControlFrame(r)
+	}
+	if err = checkFrameSize(size, maxSize); err != nil {
+		return
+	}
+	return int(size), nil
+}
+
+func (c *lengthCodec) NoCopyWrite() {}
+
+func (c *lengthCodec) controlLength() uint64 {
+	if c.size == 2 {
+		return 0xffff
+	}
+	return 0xffffffff
+}
+
+func (c *controlLengthCodec) WriteControl(w io.Writer, frame ControlFrame) (err error) {
+	buf := make([]byte, c.size+1)
+	for i := 0; i < c.size; i++ {
+		buf[i] = 0xff
+	}
+	buf[c.size] = byte(frame)
+	_, err = w.Write(buf)
+	return
+}
+
+// 读取控制帧类型
+func readControlFrame(r *bufio.Reader) error {
+	kind, err := r.ReadByte()
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	return ControlFrame(kind)
+}
+
+func (c *lengthCodec) WriteFrame(w io.Writer, frame []byte) (n int, err error) {
+	head := make([]byte, c.size)
+	max := c.controlLength()
+	if !c.control {
+		max++
+	}
+	if uint64(len(frame)) >= max {
+		return 0, ErrFrameLength
+	}
+	switch c.size {
+	case 2:
+		c.order.PutUint16(head, uint16(len(frame)))
+	case 4:
+		c.order.PutUint32(head, uint32(len(frame)))
+	}
+	if _, err = w.Write(head); err != nil {
+		return
+	}
+	return w.Write(frame)
+}
+
+// ===================================================================================
+// varint长度头部(protobuf风格); 开启控制帧时最大的uint64长度保留给控制帧
+type varintCodec struct {
+	control bool
+}
+
+// 开启控制帧的varint编解码器
+type controlVarintCodec struct {
+	*varintCodec
+}
+
+func (c *varintCodec) ReadFrame(r *bufio.Reader, maxSize int) (frame []byte, err error) {
+	n, err := c.readLength(r, maxSize)
+	if err != nil {
+		return
+	}
+	frame = make([]byte, n)
+	_, err = io.ReadFull(r, frame)
+	return
+}
+
+func (c *varintCodec) ReadFrameBuffer(r *bufio.Reader, maxSize int) (frame *Buffer, err error) {
+	n, err := c.readLength(r, maxSize)
+	if err != nil {
+		return
+	}
+	return readBuffer(r, n)
+}
+
+func (c *varintCodec) readLength(r *bufio.Reader, maxSize int) (n int, err error) {
+	size, err := c.readUvarint(r)
+	if err != nil {
+		return
+	}
+	if c.control && size == math.MaxUint64 {
+		return 0, readControlFrame(r)
+	}
+	if err = checkFrameSize(size, maxSize); err != nil {
+		return
+	}
+	return int(size), nil
+}
+
+func (c *varintCodec) readUvarint(r *bufio.Reader) (n uint64, err error) {
+	var shift uint
+	for i := 0; i < binary.MaxVarintLen64; i++ {
+		var b byte
+		if b, err = r.ReadByte(); err != nil {
+			if i > 0 && err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if b < 0x80 {
+			if i == binary.MaxVarintLen64-1 && b > 1 {
+				return 0, ErrFrameLength
+			}
+			return n | uint64(b)<<shift, nil
+		}
+		n |= uint64(b&0x7f) << shift
+		shift += 7
+	}
+	return 0, ErrFrameLength
+}
+
+func (c *varintCodec) WriteFrame(w io.Writer, frame []byte) (n int, err error) {
+	head := make([]byte, binary.MaxVarintLen64)
+	hlen := binary.PutUvarint(head, uint64(len(frame)))
+	if _, err = w.Write(head[:hlen]); err != nil {
+		return
+	}
+	return w.Write(frame)
+}
+
+func (c *varintCodec) NoCopyWrite() {}
+
+func (c *controlVarintCodec) WriteControl(w io.Writer, frame ControlFrame) (err error) {
+	buf := make([]byte, binary.MaxVarintLen64+1)
+	n := binary.PutUvarint(buf, math.MaxUint64)
+	buf[n] = byte(frame)
+	_, err = w.Write(buf[:n+1])
+	return
+}
+
+// ===================================================================================
+// 分隔符分帧, 读取时去掉分隔符, 写入时追加分隔符
+type delimiterCodec struct {
+	delim []byte
+}
+
+func NewDelimiterCodec(delim []byte) Codec {
+	if len(delim) == 0 {
+		panic("net: empty delimiter")
+	}
+	d := make([]byte, len(delim))
+	copy(d, delim)
+	return &delimiterCodec{delim: d}
+}
+
+func (c *delimiterCodec) ReadFrame(r *bufio.Reader, maxSize int) (frame []byte, err error) {
+	last := c.delim[len(c.delim)-1]
+	for {
+		// 使用ReadSlice分段读取, 避免分隔符迟迟不出现时无限增长
+		var line []byte
+		line, err = r.ReadSlice(last)
+		if err != nil && err != bufio.ErrBufferFull {
+			return nil, err
+		}
+		frame = append(frame, line...)
+		if err == nil && bytes.HasSuffix(frame, c.delim) {
+			frame = frame[:len(frame)-len(c.delim)]
+			if err = checkFrameSize(uint64(len(frame)), maxSize); err != nil {
+				return nil, err
+			}
+			return frame, nil
+		}
+		// 末尾可能是不完整的分隔符
+		if maxSize > 0 && len(frame) > maxSize+len(c.delim)-1 {
+			return nil, ErrFrameTooLarge
+		}
+	}
+}
+
+func (c *delimiterCodec) NoCopyWrite() {}
+
+func (c *delimiterCodec) WriteFrame(w io.Writer, frame []byte) (n int, err error) {
+	if bytes.Contains(frame, c.delim) {
+		return 0, errors.New("frame contains delimiter")
+	}
+	buf := make([]byte, 0, len(frame)+len(c.delim))
+	buf = append(buf, frame...)
+	buf = append(buf, c.delim...)
+	if n, err = w.Write(buf); n > len(frame) {
+		n = len(frame)
+	}
+	return
+}
+
+// ===================================================================================
+// 定长数据包, 无头部
+type fixedLengthCodec struct {
+	size int
+}
+
+func NewFixedLengthCodec(size int) Codec {
+	if size <= 0 {
+		panic("net: invalid fixed frame size")
+	}
+	return &fixedLengthCodec{size: size}
+}
+
+func (c *fixedLengthCodec) ReadFrame(r *bufio.Reader, maxSize int) (frame []byte, err error) {
+	if err = checkFrameSize(uint64(c.size), maxSize); err != nil {
+		return
+	}
+	frame = make([]byte, c.size)
+	_, err = io.ReadFull(r, frame)
+	return
+}
+
+func (c *fixedLengthCodec) ReadFrameBuffer(r *bufio.Reader, maxSize int) (frame *Buffer, err error) {
+	if err = checkFrameSize(uint64(c.size), maxSize); err != nil {
+		return
+	}
+	return readBuffer(r, c.size)
+}
+
+func (c *fixedLengthCodec) NoCopyWrite() {}
+
+func (c *fixedLengthCodec) WriteFrame(w io.Writer, frame []byte) (n int, err error) {
+	if len(frame) != c.size {
+		return 0, errors.New(fmt.Sprintf("frame size %d != %d", len(frame), c.size))
+	}
+	return w.Write(frame)
+}
+
+const maxInt = int(^uint(0) >> 1)
@@ -0,0 +1,162 @@
+package net
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"testing"
+)
+
+func Test_CodecRoundTrip(t *testing.T) {
+	codecs := map[string]Codec{
+		"uint16be":  Uint16BECodec,
+		"uint16le":  Uint16LECodec,
+		"uint32be":  Uint32BECodec,
+		"uint32le":  Uint32LECodec,
+		"varint":    VarintCodec,
+		"line":      LineCodec,
+		"delimiter": NewDelimiterCodec([]byte("\r\n")),
+		"fixed":     NewFixedLengthCodec(5),
+	}
+	frames := [][]byte{[]byte("hello"), []byte("world"), []byte("12345")}
+	for name, codec := range codecs {
+		var buf bytes.Buffer
+		for _, f := range frames {
+			if _, err := codec.WriteFrame(&buf, f); err != nil {
+				t.Fatalf("%s write frame error: %v", name, err)
+			}
+		}
+		r := bufio.NewReader(&buf)
+		for _, f := range frames {
+			got, err := codec.ReadFrame(r, 0)
+			if err != nil {
+				t.Fatalf("%s read frame error: %v", name, err)
+			}
+			if !bytes.Equal(got, f) {
+				t.Errorf("%s read frame %q, want %q", name, got, f)
+			}
+		}
+	}
+}
+
+func Test_CodecHeader(t *testing.T) {
+	var buf bytes.Buffer
+	Uint16LECodec.WriteFrame(&buf, []byte("abc"))
+	if !bytes.Equal(buf.Bytes(), []byte{3, 0, 'a', 'b', 'c'}) {
+		t.Errorf("uint16 little endian header error: %v", buf.Bytes())
+	}
+	if _, err := NewFixedLengthCodec(4).WriteFrame(&buf, []byte("abc")); err == nil {
+		t.Error("fixed length codec accepted short frame")
+	}
+	if _, err := LineCodec.WriteFrame(&buf, []byte("a\nb")); err == nil {
+		t.Error("line codec accepted frame containing delimiter")
+	}
+}
+
+func Test_CodecMaxFrameSize(t *testing.T) {
+	codecs := map[string]Codec{
+		"uint32be": Uint32BECodec,
+		"varint":   VarintCodec,
+		"line":     LineCodec,
+		"fixed":    NewFixedLengthCodec(64),
+	}
+	frame := bytes.Repeat([]byte("x"), 64)
+	for name, codec := range codecs {
+		var buf bytes.Buffer
+		codec.WriteFrame(&buf, frame)
+		if _, err := codec.ReadFrame(bufio.NewReader(&buf), 32); err != ErrFrameTooLarge {
+			t.Errorf("%s read oversize frame got %v, want ErrFrameTooLarge", name, err)
+		}
+	}
+	// 恶意头部不应导致大内存分配
+	r := bufio.NewReader(bytes.NewReader([]byte{0xff, 0xff, 0xff, 0xff}))
+	if _, err := Uint32BECodec.ReadFrame(r, defaultMaxFrameSize); err != ErrFrameTooLarge {
+		t.Errorf("read 4G header got %v, want ErrFrameTooLarge", err)
+	}
+}
+
+func Test_CodecControlFrame(t *testing.T) {
+	codecs := map[string]Codec{
+		"uint16be": Uint16BECodec,
+		"uint32le": Uint32LECodec,
+		"varint":   VarintCodec,
+	}
+	for name, plain := range codecs {
+		if _, ok := plain.(ControlCodec); ok {
+			t.Fatalf("%s supports control frames without NewHeartbeatCodec", name)
+		}
+		codec, err := NewHeartbeatCodec(plain)
+		if err != nil {
+			t.Fatalf("%s heartbeat codec: %v", name, err)
+		}
+		cc := codec.(ControlCodec)
+		var buf bytes.Buffer
+		cc.WriteControl(&buf, ControlPing)
+		codec.WriteFrame(&buf, []byte("PING"))
+		cc.WriteControl(&buf, ControlPong)
+		r := bufio.NewReader(&buf)
+		if _, err := codec.ReadFrame(r, 0); err != ControlPing {
+			t.Errorf("%s read %v, want ping", name, err)
+		}
+		if got, err := codec.ReadFrame(r, 0); err != nil || string(got) != "PING" {
+			t.Errorf("%s read %q %v, want data frame", name, got, err)
+		}
+		if _, err := codec.ReadFrame(r, 0); err != ControlPong {
+			t.Errorf("%s read %v, want pong", name, err)
+		}
+	}
+	// 保留给控制帧的长度不能用于数据包
+	hb, _ := NewHeartbeatCodec(Uint16BECodec)
+	if _, err := hb.WriteFrame(&bytes.Buffer{}, make([]byte, 0xffff)); err != ErrFrameLength {
+		t.Errorf("uint16 heartbeat codec accepted reserved length: %v", err)
+	}
+	// 未开启控制帧时格式不变, 全1的长度是普通数据包
+	var buf bytes.Buffer
+	frame := bytes.Repeat([]byte("x"), 0xffff)
+	if _, err := Uint16BECodec.WriteFrame(&buf, frame); err != nil {
+		t.Fatalf("uint16 codec rejected 65535-byte frame: %v", err)
+	}
+	if got, err := Uint16BECodec.ReadFrame(bufio.NewReader(&buf), 0); err != nil || len(got) != 0xffff {
+		t.Errorf("uint16 codec read %d bytes %v, want 65535-byte frame", len(got), err)
+	}
+	for _, codec := range []Codec{LineCodec, NewFixedLengthCodec(4)} {
+		if _, err := NewHeartbeatCodec(codec); err != ErrHeartbeatCodec {
+			t.Errorf("%T heartbeat codec returned %v", codec, err)
+		}
+	}
+}
+
+// 复用头部缓冲区的编解码器, 没有实现NoCopyCodec
+type reuseHeaderCodec struct {
+	header [1]byte
+}
+
+func (c *reuseHeaderCodec) ReadFrame(r *bufio.Reader, maxSize int) (frame []byte, err error) {
+	return nil, nil
+}
+
+func (c *reuseHeaderCodec) WriteFrame(w io.Writer, frame []byte) (n int, err error) {
+	c.header[0] = byte(len(frame))
+	if _, err = w.Write(c.header[:]); err != nil {
+		return
+	}
+	return w.Write(frame)
+}
+
+func Test_WriterCopyUnlessNoCopy(t *testing.T) {
+	var buf bytes.Buffer
+	w := newWriter(&buf, &reuseHeaderCodec{})
+	w.encode([]byte("a"))
+	w.encode([]byte("bcd"))
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{1, 'a', 3, 'b', 'c', 'd'}; !bytes.Equal(buf.Bytes(), want) {
+		t.Errorf("writer output %v, want %v", buf.Bytes(), want)
+	}
+	for _, codec := range []Codec{Uint16BECodec, VarintCodec, LineCodec, NewFixedLengthCodec(4)} {
+		if _, ok := codec.(NoCopyCodec); !ok {
+			t.Errorf("%T should not copy frames", codec)
+		}
+	}
+}
@@ -5,12 +5,14 @@ import (
 	"fmt"
 	"net"
 	"regexp"
+	"strconv"
 	"strings"
 )
 
 const (
-	defaultHeadSize   = 4
 	defaultPacketSize = 4 * 1024
+	// 默认最大数据包长度, 防止异常头部导致超大内存分配
+	defaultMaxFrameSize = 16 * 1024 * 1024
 )
 
 //ratelimit
@@ -25,8 +27,36 @@ var (
 	OnConnect    = func(conn *TcpConnection) {}
 	OnDisconnect = func(conn *TcpConnection) {}
 	OnDataOut    = func(conn net.Conn, msg []byte) {}
+	// 数据包无法解析(如超过最大长度)时调用, 之后连接会被关闭
+	OnProtocolError = func(conn *TcpConnection, err error) {}
+	// 连接因数量限制或IP名单被拒绝时调用, 之后连接会被关闭
+	OnReject = func(conn net.Conn, reason error) {}
+	// 连接读空闲超时或心跳连续丢失时调用, 之后连接会被关闭
+	OnIdle = func(conn *TcpConnection) {}
+	// 开启PooledBuffers后替代OnDataIn, 处理完需调用buf.Release();
+	// 默认拷贝数据后归还缓冲池, 再调用OnDataIn
+	OnBufferIn = func(conn *TcpConnection, buf *Buffer) {
+		msg := make([]byte, buf.Len())
+		copy(msg, buf.Bytes())
+		buf.Release()
+		OnDataIn(conn, msg)
+	}
 )
 
+// 因协议错误被拒绝的数据包数
+var rejectedFrameCount uint64
+
+// 最大数据包长度, 0使用默认值, 小于0不限制
+func normalizeMaxFrameSize(size int) int {
+	if size == 0 {
+		return defaultMaxFrameSize
+	}
+	if size < 0 {
+		return 0
+	}
+	return size
+}
+
 func isIPv4(ip string) bool {
 	if m, _ := regexp.MatchString("^[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}\\.[0-9]{1,3}$", ip); !m {
 		return false
@@ -46,6 +76,18 @@ func isIP(ip string) bool {
 	return true
 }
 
+func listenTCP(listen_addr string, listen_port int) (listener net.Listener, err error) {
+	if isUnixAddr(listen_addr) {
+		return listenUnix(strings.TrimPrefix(listen_addr, unixAddrPrefix))
+	}
+	listen_ip, err := parseListenAddr(listen_addr)
+	if err != nil {
+		return
+	}
+	address := net.JoinHostPort(listen_ip, strconv.Itoa(listen_port))
+	return net.Listen("tcp", address)
+}
+
 func parseListenAddr(addr string) (ip string, err error) {
 	if len(addr) <= 0 {
 		err = errors.New("addr is empty")
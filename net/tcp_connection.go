@@ -10,15 +10,36 @@ import (
 type TcpConnection struct {
 	id   uint64
 	conn net.Conn
+	// 底层连接, TLS连接时为握手前的原始连接
+	rawConn net.Conn
 
 	// About send and receive
+	codec     Codec
 	reader    *reader
 	writer    *writer
 	sendMutex sync.Mutex
 	recvMutex sync.Mutex
 
+	// 正在处理的请求, 用于优雅关闭
+	requestWait sync.WaitGroup
+
+	// 所属服务的钩子函数, 为空时使用全局钩子函数
+	hooks *TCPHooks
+
+	// 业务数据
+	meta connMeta
+
+	// 心跳和读空闲超时
+	heartbeat       atomic.Value
+	readIdleTimeout int64
+	readStopped     int32
+
+	// 异步发送队列, 为空时同步发送
+	asyncWriter atomic.Value
+
 	// About close
 	closeFlag int32
+	closed    chan struct{}
 }
 
 var (
@@ -30,49 +51,185 @@ const (
 	defaultKeepAlivePeriod = 10 * time.Second
 )
 
-func newTcpConnection(conn net.Conn) *TcpConnection {
+func newTcpConnection(conn net.Conn, codec Codec) *TcpConnection {
+	if codec == nil {
+		codec = DefaultCodec
+	}
 	return &TcpConnection{
-		id:     atomic.AddUint64(&globalTcpConnectionId, 1),
-		conn:   conn,
-		reader: newReader(conn),
-		writer: newWriter(conn),
+		id:      atomic.AddUint64(&globalTcpConnectionId, 1),
+		conn:    conn,
+		rawConn: conn,
+		codec:   codec,
+		reader:  newReader(conn, codec),
+		writer:  newWriter(conn, codec),
+		closed:  make(chan struct{}),
 	}
 }
 
 func (c *TcpConnection) Id() uint64     { return c.id }
 func (c *TcpConnection) Conn() net.Conn { return c.conn }
+func (c *TcpConnection) Codec() Codec   { return c.codec }
 func (c *TcpConnection) IsClosed() bool { return atomic.LoadInt32(&c.closeFlag) != 0 }
 
+// 连接关闭后返回的channel被关闭, 用于取消与连接相关的处理
+func (c *TcpConnection) Done() <-chan struct{} { return c.closed }
+
 func (c *TcpConnection) Receive() (msg []byte, err error) {
+	if msg, err = c.receive(); err != nil {
+		c.Close()
+	}
+	return
+}
+
+// 读取一个数据包, 出错时不关闭连接; 心跳帧在这里处理, 不返回给调用方
+func (c *TcpConnection) receive() (msg []byte, err error) {
 	c.recvMutex.Lock()
 	defer c.recvMutex.Unlock()
-	if msg, err = c.reader.readPacket(); err != nil {
+	for {
+		c.resetReadIdleDeadline()
+		if msg, err = c.reader.readPacket(); err != nil {
+			if frame, ok := err.(ControlFrame); ok {
+				c.handleControl(frame)
+				continue
+			}
+			c.onReadError(err)
+			return
+		}
+		c.heartbeatReceived()
+		return
+	}
+}
+
+// 读取一个数据包到缓冲池内存, 使用完后需调用Release; 出错时关闭连接
+func (c *TcpConnection) ReceiveBuffer() (buf *Buffer, err error) {
+	if buf, err = c.receiveBuffer(); err != nil {
 		c.Close()
 	}
 	return
 }
 
+func (c *TcpConnection) receiveBuffer() (buf *Buffer, err error) {
+	c.recvMutex.Lock()
+	defer c.recvMutex.Unlock()
+	for {
+		c.resetReadIdleDeadline()
+		if buf, err = c.reader.readBuffer(); err != nil {
+			if frame, ok := err.(ControlFrame); ok {
+				c.handleControl(frame)
+				continue
+			}
+			c.onReadError(err)
+			return
+		}
+		c.heartbeatReceived()
+		return
+	}
+}
+
+func (c *TcpConnection) onReadError(err error) {
+	if isProtocolError(err) {
+		atomic.AddUint64(&rejectedFrameCount, 1)
+		// 钩子函数，用于业务server嵌入协议错误时的逻辑
+		c.hooks.onProtocolError(c, err)
+	}
+}
+
+// 设置最大数据包长度, 0使用默认值, 小于0不限制
+func (c *TcpConnection) SetMaxFrameSize(size int) {
+	c.recvMutex.Lock()
+	defer c.recvMutex.Unlock()
+	c.reader.maxFrameSize = normalizeMaxFrameSize(size)
+}
+
 func (c *TcpConnection) Send(msg []byte) (n int, err error) {
+	if aw := c.getAsyncWriter(); aw != nil {
+		if err = <-aw.send(msg); err == nil {
+			n = len(msg)
+		}
+		return
+	}
 	c.sendMutex.Lock()
 	defer c.sendMutex.Unlock()
 	if n, err = c.writer.writePacket(msg); err != nil {
 		c.Close()
 	}
 	// 用于嵌入发包成功的逻辑，用于调试
-	OnDataOut(c.conn, msg)
+	c.hooks.onDataOut(c.conn, msg)
+	return
+}
+
+// 带写超时的发送, timeOut为0时不超时; 超时后连接被关闭
+func (c *TcpConnection) SendTimeout(msg []byte, timeOut time.Duration) (n int, err error) {
+	if aw := c.getAsyncWriter(); aw != nil {
+		if err = waitSendResult(aw.send(msg), timeOut); err == nil {
+			n = len(msg)
+		} else if err == ErrTCPTimeout {
+			c.Close()
+		}
+		return
+	}
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if timeOut > 0 {
+		if err = c.conn.SetWriteDeadline(time.Now().Add(timeOut)); err != nil {
+			c.Close()
+			return
+		}
+		defer c.conn.SetWriteDeadline(noDeadline)
+	}
+	if n, err = c.writer.writePacket(msg); err != nil {
+		c.Close()
+		return
+	}
+	c.hooks.onDataOut(c.conn, msg)
+	return
+}
+
+// 发送控制帧, timeOut为0时不超时; 失败时关闭连接
+func (c *TcpConnection) sendControl(frame ControlFrame, timeOut time.Duration) (err error) {
+	if aw := c.getAsyncWriter(); aw != nil {
+		if err = waitSendResult(aw.sendControl(frame), timeOut); err == ErrTCPTimeout {
+			c.Close()
+		}
+		return
+	}
+	c.sendMutex.Lock()
+	defer c.sendMutex.Unlock()
+	if timeOut > 0 {
+		if err = c.conn.SetWriteDeadline(time.Now().Add(timeOut)); err != nil {
+			c.Close()
+			return
+		}
+		defer c.conn.SetWriteDeadline(noDeadline)
+	}
+	if err = c.writer.writeControl(frame); err != nil {
+		c.Close()
+	}
 	return
 }
 
 func (c *TcpConnection) Close() {
 	if atomic.CompareAndSwapInt32(&c.closeFlag, 0, 1) {
+		close(c.closed)
 		c.conn.Close()
+		if aw := c.getAsyncWriter(); aw != nil {
+			aw.stop()
+		}
 		//钩子函数，用于业务server嵌入连接关闭时的逻辑
-		OnDisconnect(c)
+		c.hooks.onDisconnect(c)
+	}
+}
+
+// 关闭连接但不调用钩子函数, 用于调用OnConnect之前的关闭; 与Close并发时只有一个生效
+func (c *TcpConnection) closeWithoutHooks() {
+	if atomic.CompareAndSwapInt32(&c.closeFlag, 0, 1) {
+		close(c.closed)
+		c.conn.Close()
 	}
 }
 
 func (c *TcpConnection) SetKeepAlive(period time.Duration) (err error) {
-	if tc, ok := c.conn.(*net.TCPConn); ok {
+	if tc, ok := c.rawConn.(*net.TCPConn); ok {
 		if err = tc.SetKeepAlive(true); err != nil {
 			return
 		}
@@ -84,34 +241,28 @@ func (c *TcpConnection) SetKeepAlive(period time.Duration) (err error) {
 }
 
 func (c *TcpConnection) SetReadDeadline(timeOut time.Duration) (err error) {
-	if tc, ok := c.conn.(*net.TCPConn); ok {
-		if timeOut != 0 {
-			err = tc.SetReadDeadline(time.Now().Add(timeOut))
-		} else {
-			err = tc.SetReadDeadline(noDeadline)
-		}
+	if timeOut != 0 {
+		err = c.conn.SetReadDeadline(time.Now().Add(timeOut))
+	} else {
+		err = c.conn.SetReadDeadline(noDeadline)
 	}
 	return
 }
 
 func (c *TcpConnection) SetWriteDeadline(timeOut time.Duration) (err error) {
-	if tc, ok := c.conn.(*net.TCPConn); ok {
-		if timeOut != 0 {
-			err = tc.SetWriteDeadline(time.Now().Add(timeOut))
-		} else {
-			err = tc.SetWriteDeadline(noDeadline)
-		}
+	if timeOut != 0 {
+		err = c.conn.SetWriteDeadline(time.Now().Add(timeOut))
+	} else {
+		err = c.conn.SetWriteDeadline(noDeadline)
 	}
 	return
 }
 
 func (c *TcpConnection) SetDeadline(timeOut time.Duration) (err error) {
-	if tc, ok := c.conn.(*net.TCPConn); ok {
-		if timeOut != 0 {
-			err = tc.SetDeadline(time.Now().Add(timeOut))
-		} else {
-			err = tc.SetDeadline(noDeadline)
-		}
+	if timeOut != 0 {
+		err = c.conn.SetDeadline(time.Now().Add(timeOut))
+	} else {
+		err = c.conn.SetDeadline(noDeadline)
 	}
 	return
 }
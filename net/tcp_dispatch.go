@@ -0,0 +1,291 @@
+package net
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/xuhn/optimusprime/log"
+)
+
+// 队列满时的处理策略
+type QueueFullPolicy int
+
+const (
+	// 阻塞读取, 直到队列有空位, 形成背压
+	QueueFullBlock QueueFullPolicy = iota
+	// 回复错误帧并丢弃该请求
+	QueueFullReject
+	// 关闭连接
+	QueueFullClose
+)
+
+const (
+	defaultDispatchQueueSize = 1024
+	defaultConnQueueSize     = 64
+)
+
+var (
+	ErrServerBusy = errors.New("server busy")
+)
+
+// TCP请求分发配置, 零值与不配置相同: 每个请求启动一个goroutine处理
+type DispatchConfig struct {
+	// 全局worker数, 0不使用worker池
+	Workers int
+	// 全局等待队列长度, 0使用默认值1024
+	QueueSize int
+	// 单连接同时处理的请求数, 0不限制
+	MaxPerConn int
+	// 单连接内按接收顺序逐个处理, 开启后忽略MaxPerConn
+	Ordered bool
+	// 有序处理时单连接的等待队列长度, 0使用默认值64
+	ConnQueueSize int
+	// 队列满时的处理策略
+	QueueFullPolicy QueueFullPolicy
+	// QueueFullReject时回复的错误帧, 为空时回复ErrServerBusy的文本
+	RejectFrame func(c *TcpConnection, req []byte) []byte
+}
+
+// 请求分发统计
+type DispatchStats struct {
+	Workers       int    // worker数
+	QueueDepth    int    // 全局队列中等待的请求数
+	QueueCapacity int    // 全局队列长度
+	Running       int64  // 正在处理的请求数
+	ConnPending   int64  // 各连接有序队列中等待的请求数
+	Blocked       uint64 // 队列满时阻塞读取的次数
+	Rejected      uint64 // 队列满时拒绝的请求数
+	Closed        uint64 // 队列满时关闭的连接数
+}
+
+type dispatcher struct {
+	config DispatchConfig
+
+	// 关闭后不再向tasks投递, 剩余任务由worker处理完
+	mu     sync.RWMutex
+	closed bool
+	tasks  chan func()
+
+	running     int64
+	connPending int64
+	blocked     uint64
+	rejected    uint64
+	closedConns uint64
+}
+
+func newDispatcher(config *DispatchConfig) *dispatcher {
+	d := &dispatcher{}
+	if config != nil {
+		d.config = *config
+	}
+	if d.config.Workers > 0 {
+		if d.config.QueueSize <= 0 {
+			d.config.QueueSize = defaultDispatchQueueSize
+		}
+		d.tasks = make(chan func(), d.config.QueueSize)
+		for i := 0; i < d.config.Workers; i++ {
+			go d.work()
+		}
+	}
+	if d.config.Ordered && d.config.ConnQueueSize <= 0 {
+		d.config.ConnQueueSize = defaultConnQueueSize
+	}
+	return d
+}
+
+func (d *dispatcher) work() {
+	for task := range d.tasks {
+		task()
+	}
+}
+
+func (d *dispatcher) run(task func()) {
+	atomic.AddInt64(&d.running, 1)
+	defer atomic.AddInt64(&d.running, -1)
+	task()
+}
+
+// 投递任务, block为false且队列已满时返回false
+func (d *dispatcher) submit(task func(), block bool) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	wrapped := func() { d.run(task) }
+	if d.tasks == nil || d.closed {
+		go wrapped()
+		return true
+	}
+	select {
+	case d.tasks <- wrapped:
+		return true
+	default:
+	}
+	if !block {
+		return false
+	}
+	atomic.AddUint64(&d.blocked, 1)
+	d.tasks <- wrapped
+	return true
+}
+
+// 停止worker, 已在队列中的任务仍会被处理
+func (d *dispatcher) close() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return
+	}
+	d.closed = true
+	if d.tasks != nil {
+		close(d.tasks)
+	}
+}
+
+func (d *dispatcher) stats() DispatchStats {
+	return DispatchStats{
+		Workers:       d.config.Workers,
+		QueueDepth:    len(d.tasks),
+		QueueCapacity: cap(d.tasks),
+		Running:       atomic.LoadInt64(&d.running),
+		ConnPending:   atomic.LoadInt64(&d.connPending),
+		Blocked:       atomic.LoadUint64(&d.blocked),
+		Rejected:      atomic.LoadUint64(&d.rejected),
+		Closed:        atomic.LoadUint64(&d.closedConns),
+	}
+}
+
+// 队列满时按策略处理
+func (d *dispatcher) onQueueFull(c *TcpConnection, req []byte) {
+	switch d.config.QueueFullPolicy {
+	case QueueFullReject:
+		atomic.AddUint64(&d.rejected, 1)
+		frame := []byte(ErrServerBusy.Error())
+		if d.config.RejectFrame != nil {
+			frame = d.config.RejectFrame(c, req)
+		}
+		c.Send(frame)
+	default:
+		atomic.AddUint64(&d.closedConns, 1)
+		log.WARNF("connection [ %s -> %s ] dispatch queue full, close", c.conn.RemoteAddr(), c.conn.LocalAddr())
+		c.Close()
+	}
+}
+
+// ===================================================================================
+// 单连接的分发状态
+type connDispatcher struct {
+	d       *dispatcher
+	c       *TcpConnection
+	handler requestHandler
+
+	// 单连接并发限制
+	slots chan bool
+	// 有序处理队列
+	queue chan dispatchRequest
+}
+
+// 请求处理函数, buf不为空时req为buf.Bytes(), 由处理函数负责归还
+type requestHandler func(c *TcpConnection, req []byte, buf *Buffer)
+
+type dispatchRequest struct {
+	req []byte
+	buf *Buffer
+}
+
+func (d *dispatcher) newConnDispatcher(c *TcpConnection, handler requestHandler) *connDispatcher {
+	cd := &connDispatcher{d: d, c: c, handler: handler}
+	if d.config.Ordered {
+		cd.queue = make(chan dispatchRequest, d.config.ConnQueueSize)
+		go cd.serveOrdered()
+	} else if d.config.MaxPerConn > 0 {
+		cd.slots = make(chan bool, d.config.MaxPerConn)
+	}
+	return cd
+}
+
+func (cd *connDispatcher) block() bool {
+	return cd.d.config.QueueFullPolicy == QueueFullBlock
+}
+
+// 队列满时按策略处理, 被丢弃的请求归还缓冲
+func (cd *connDispatcher) onQueueFull(req []byte, buf *Buffer) {
+	cd.d.onQueueFull(cd.c, req)
+	if buf != nil {
+		buf.Release()
+	}
+}
+
+// 分发一个请求, 队列满时按策略阻塞, 拒绝或关闭连接
+func (cd *connDispatcher) dispatch(req []byte, buf *Buffer) {
+	if cd.queue != nil {
+		cd.enqueue(dispatchRequest{req: req, buf: buf})
+		return
+	}
+	if cd.slots != nil {
+		select {
+		case cd.slots <- true:
+		default:
+			if !cd.block() {
+				cd.onQueueFull(req, buf)
+				return
+			}
+			atomic.AddUint64(&cd.d.blocked, 1)
+			cd.slots <- true
+		}
+	}
+	cd.c.requestWait.Add(1)
+	task := func() {
+		defer cd.c.requestWait.Done()
+		cd.handler(cd.c, req, buf)
+		if cd.slots != nil {
+			<-cd.slots
+		}
+	}
+	if !cd.d.submit(task, cd.block()) {
+		cd.c.requestWait.Done()
+		if cd.slots != nil {
+			<-cd.slots
+		}
+		cd.onQueueFull(req, buf)
+	}
+}
+
+func (cd *connDispatcher) enqueue(req dispatchRequest) {
+	cd.c.requestWait.Add(1)
+	atomic.AddInt64(&cd.d.connPending, 1)
+	select {
+	case cd.queue <- req:
+		return
+	default:
+	}
+	if cd.block() {
+		atomic.AddUint64(&cd.d.blocked, 1)
+		cd.queue <- req
+		return
+	}
+	atomic.AddInt64(&cd.d.connPending, -1)
+	cd.c.requestWait.Done()
+	cd.onQueueFull(req.req, req.buf)
+}
+
+// 按顺序处理连接上的请求, 每个请求仍在全局worker池中执行
+func (cd *connDispatcher) serveOrdered() {
+	done := make(chan bool)
+	for req := range cd.queue {
+		atomic.AddInt64(&cd.d.connPending, -1)
+		req := req
+		cd.d.submit(func() {
+			defer func() { done <- true }()
+			cd.handler(cd.c, req.req, req.buf)
+		}, true)
+		<-done
+		cd.c.requestWait.Done()
+	}
+}
+
+// 连接读取结束, 已排队的请求仍会被处理
+func (cd *connDispatcher) close() {
+	if cd.queue != nil {
+		close(cd.queue)
+	}
+}
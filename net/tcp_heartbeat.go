@@ -0,0 +1,211 @@
+package net
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xuhn/optimusprime/log"
+)
+
+const (
+	defaultMaxMissedHeartbeats = 3
+)
+
+var (
+	ErrHeartbeatCodec = errors.New("codec does not support control frames, heartbeat unavailable")
+)
+
+// 应用层心跳配置; ping/pong使用编解码层的控制帧, 不会与业务数据包混淆, 也不会传给OnDataIn
+// 配置心跳的服务端和客户端自动使用NewHeartbeatCodec开启控制帧, 通信双方需同时开启;
+// 对端收到ping时自动回复pong
+type HeartbeatConfig struct {
+	// 连接空闲时发送ping的周期, 0不主动发送, 只回复对端的ping
+	Interval time.Duration
+	// 连续MaxMissed个周期未收到任何数据后关闭连接, 0使用默认值3
+	MaxMissed int
+}
+
+var (
+	clientHeartbeatMu sync.RWMutex
+	clientHeartbeat   *HeartbeatConfig
+)
+
+type heartbeat struct {
+	config   HeartbeatConfig
+	lastRecv int64
+	missed   int32
+	// 收到对端的心跳帧后才主动发送ping, 确认对端也开启了心跳
+	waitPeer bool
+	peerSeen int32
+}
+
+func newHeartbeat(config HeartbeatConfig) *heartbeat {
+	if config.MaxMissed <= 0 {
+		config.MaxMissed = defaultMaxMissedHeartbeats
+	}
+	return &heartbeat{
+		config:   config,
+		lastRecv: time.Now().UnixNano(),
+	}
+}
+
+func (hb *heartbeat) received() {
+	atomic.StoreInt64(&hb.lastRecv, time.Now().UnixNano())
+	atomic.StoreInt32(&hb.missed, 0)
+}
+
+func (hb *heartbeat) idleTime() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&hb.lastRecv))
+}
+
+// 开启心跳; Interval大于0时定时发送ping, 需要有goroutine持续读取该连接才能收到pong
+// 编解码器不支持控制帧时返回ErrHeartbeatCodec
+func (c *TcpConnection) StartHeartbeat(config HeartbeatConfig) error {
+	return c.startHeartbeat(config, false)
+}
+
+func (c *TcpConnection) startHeartbeat(config HeartbeatConfig, waitPeer bool) error {
+	if _, ok := c.codec.(ControlCodec); !ok {
+		return ErrHeartbeatCodec
+	}
+	hb := newHeartbeat(config)
+	hb.waitPeer = waitPeer
+	c.heartbeat.Store(hb)
+	if hb.config.Interval > 0 {
+		go c.heartbeatServe(hb)
+	}
+	return nil
+}
+
+func (c *TcpConnection) getHeartbeat() *heartbeat {
+	hb, _ := c.heartbeat.Load().(*heartbeat)
+	return hb
+}
+
+// 连续未收到数据的心跳周期数
+func (c *TcpConnection) MissedHeartbeats() int {
+	if hb := c.getHeartbeat(); hb != nil {
+		return int(atomic.LoadInt32(&hb.missed))
+	}
+	return 0
+}
+
+func (c *TcpConnection) heartbeatServe(hb *heartbeat) {
+	ticker := time.NewTicker(hb.config.Interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		// 连接关闭或心跳配置被替换后退出
+		if c.IsClosed() || c.getHeartbeat() != hb {
+			return
+		}
+		if hb.idleTime() < hb.config.Interval {
+			continue
+		}
+		if hb.waitPeer && atomic.LoadInt32(&hb.peerSeen) == 0 {
+			continue
+		}
+		if missed := atomic.AddInt32(&hb.missed, 1); int(missed) > hb.config.MaxMissed {
+			log.WARNF("connection [ %s -> %s ] missed %d heartbeats, close", c.conn.LocalAddr(), c.conn.RemoteAddr(), missed-1)
+			c.closeIdle()
+			return
+		}
+		c.sendControl(ControlPing, hb.config.Interval)
+	}
+}
+
+// 收到业务数据包
+func (c *TcpConnection) heartbeatReceived() {
+	if hb := c.getHeartbeat(); hb != nil {
+		hb.received()
+	}
+}
+
+// 处理控制帧; 未开启心跳时也回复ping, 未知类型忽略
+func (c *TcpConnection) handleControl(frame ControlFrame) {
+	if hb := c.getHeartbeat(); hb != nil {
+		hb.received()
+		atomic.StoreInt32(&hb.peerSeen, 1)
+	}
+	if frame == ControlPing {
+		c.sendControl(ControlPong, 0)
+	}
+}
+
+// 读空闲超时, 0不超时
+func (c *TcpConnection) SetReadIdleTimeout(timeOut time.Duration) {
+	atomic.StoreInt64(&c.readIdleTimeout, int64(timeOut))
+}
+
+// 每次读取前重置读超时
+func (c *TcpConnection) resetReadIdleDeadline() {
+	timeOut := time.Duration(atomic.LoadInt64(&c.readIdleTimeout))
+	if timeOut <= 0 {
+		return
+	}
+	c.conn.SetReadDeadline(time.Now().Add(timeOut))
+	// 与stopRead并发时, 保证停止读取的deadline不被覆盖
+	if atomic.LoadInt32(&c.readStopped) != 0 {
+		c.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// 唤醒阻塞在读上的goroutine, 之后不再读取新的数据包
+func (c *TcpConnection) stopRead() {
+	atomic.StoreInt32(&c.readStopped, 1)
+	c.conn.SetReadDeadline(time.Now())
+}
+
+// 空闲超时关闭连接
+func (c *TcpConnection) closeIdle() {
+	// 钩子函数，用于业务server嵌入连接空闲时的逻辑
+	c.hooks.onIdle(c)
+	c.Close()
+}
+
+// 客户端心跳配置, 对新建立的连接生效
+func setClientHeartbeat(config *HeartbeatConfig) {
+	clientHeartbeatMu.Lock()
+	defer clientHeartbeatMu.Unlock()
+	clientHeartbeat = config
+}
+
+// 新建客户端连接使用的编解码器, 开启客户端心跳时支持控制帧
+func getClientConnCodec(remote_addr string) Codec {
+	codec := getClientCodec(remote_addr)
+	clientHeartbeatMu.RLock()
+	config := clientHeartbeat
+	clientHeartbeatMu.RUnlock()
+	if config == nil {
+		return codec
+	}
+	if cc, err := NewHeartbeatCodec(codec); err == nil {
+		codec = cc
+	}
+	return codec
+}
+
+// 客户端连接开启心跳; 连接池中的空闲连接没有goroutine读取, 不主动发送ping,
+// 多路复用连接在收到服务端的心跳帧后才主动发送ping, 服务端未开启心跳时不发送
+func startClientHeartbeat(c *TcpConnection, active bool) {
+	clientHeartbeatMu.RLock()
+	config := clientHeartbeat
+	clientHeartbeatMu.RUnlock()
+	if config == nil {
+		return
+	}
+	hb := *config
+	if !active {
+		hb.Interval = 0
+	}
+	if err := c.startHeartbeat(hb, true); err != nil {
+		log.DEBUGF("connection [ %s -> %s ] heartbeat not started:%v", c.conn.LocalAddr(), c.conn.RemoteAddr(), err)
+	}
+}
+
+func isTimeoutError(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
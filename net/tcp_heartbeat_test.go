@@ -0,0 +1,120 @@
+package net
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// ping/pong在编解码层处理, 与心跳帧内容相同的业务数据包正常传递
+func Test_HeartbeatControlFrame(t *testing.T) {
+	client, server := net.Pipe()
+	codec, _ := NewHeartbeatCodec(DefaultCodec)
+	a := newTcpConnection(server, codec)
+	b := newTcpConnection(client, codec)
+	defer a.Close()
+	defer b.Close()
+	// a未开启心跳, 只回显数据包
+	go func() {
+		for {
+			msg, err := a.Receive()
+			if err != nil {
+				return
+			}
+			a.Send(msg)
+		}
+	}()
+	if err := b.startHeartbeat(HeartbeatConfig{}, true); err != nil {
+		t.Fatal(err)
+	}
+	// net.Pipe没有缓冲, 先开始读取才能收到pong
+	received := make(chan []byte, 1)
+	go func() {
+		msg, _ := b.Receive()
+		received <- msg
+	}()
+	if err := b.sendControl(ControlPing, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	payload := []byte("\x00\x00PING\x00\x00")
+	b.Send(payload)
+	select {
+	case got := <-received:
+		if string(got) != string(payload) {
+			t.Fatalf("receive %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("receive timeout")
+	}
+	if atomic.LoadInt32(&b.getHeartbeat().peerSeen) != 1 {
+		t.Error("pong not received")
+	}
+}
+
+// 客户端在对端发送心跳前不主动发送ping
+func Test_HeartbeatWaitPeer(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	var received int32
+	go func() {
+		buf := make([]byte, 64)
+		for {
+			n, err := server.Read(buf)
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&received, int32(n))
+		}
+	}()
+	codec, _ := NewHeartbeatCodec(DefaultCodec)
+	c := newTcpConnection(client, codec)
+	defer c.Close()
+	if err := c.startHeartbeat(HeartbeatConfig{Interval: 10 * time.Millisecond, MaxMissed: 1}, true); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if atomic.LoadInt32(&received) != 0 || c.IsClosed() {
+		t.Fatalf("sent %d bytes, closed %v", received, c.IsClosed())
+	}
+
+	for _, plain := range []Codec{DefaultCodec, LineCodec} {
+		if err := newTcpConnection(client, plain).StartHeartbeat(HeartbeatConfig{}); err != ErrHeartbeatCodec {
+			t.Errorf("%T heartbeat without control frames: %v", plain, err)
+		}
+	}
+}
+
+// 只有配置心跳时服务端和客户端才使用控制帧
+func Test_HeartbeatCodecOptIn(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	s, err := newTcpServer(listener, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.codec.(ControlCodec); ok {
+		t.Error("server codec has control frames without heartbeat")
+	}
+	if s, err = newTcpServer(listener, &TCPServerConfig{Heartbeat: &HeartbeatConfig{}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.codec.(ControlCodec); !ok {
+		t.Error("server codec has no control frames with heartbeat")
+	}
+	if _, err = newTcpServer(listener, &TCPServerConfig{Codec: LineCodec, Heartbeat: &HeartbeatConfig{}}); err != ErrHeartbeatCodec {
+		t.Errorf("line codec with heartbeat: %v", err)
+	}
+
+	if _, ok := getClientConnCodec("127.0.0.1:1").(ControlCodec); ok {
+		t.Error("client codec has control frames without heartbeat")
+	}
+	SetTCPClientHeartbeat(&HeartbeatConfig{})
+	defer SetTCPClientHeartbeat(nil)
+	if _, ok := getClientConnCodec("127.0.0.1:1").(ControlCodec); !ok {
+		t.Error("client codec has no control frames with heartbeat")
+	}
+}
@@ -0,0 +1,155 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"sync"
+)
+
+// 单个TCP服务的钩子函数, 为空的字段使用同名的全局钩子函数,
+// 用于一个进程内运行多个协议不同的TCP服务
+type TCPHooks struct {
+	OnDataIn        func(conn *TcpConnection, msg []byte)
+	OnConnect       func(conn *TcpConnection)
+	OnDisconnect    func(conn *TcpConnection)
+	OnDataOut       func(conn net.Conn, msg []byte)
+	OnProtocolError func(conn *TcpConnection, err error)
+	OnReject        func(conn net.Conn, reason error)
+	OnIdle          func(conn *TcpConnection)
+	// 为空且设置了OnDataIn时, 拷贝数据后归还缓冲池, 再调用OnDataIn
+	OnBufferIn func(conn *TcpConnection, buf *Buffer)
+}
+
+func (h *TCPHooks) onDataIn(conn *TcpConnection, msg []byte) {
+	if h != nil && h.OnDataIn != nil {
+		h.OnDataIn(conn, msg)
+		return
+	}
+	OnDataIn(conn, msg)
+}
+
+func (h *TCPHooks) onConnect(conn *TcpConnection) {
+	if h != nil && h.OnConnect != nil {
+		h.OnConnect(conn)
+		return
+	}
+	OnConnect(conn)
+}
+
+func (h *TCPHooks) onDisconnect(conn *TcpConnection) {
+	if h != nil && h.OnDisconnect != nil {
+		h.OnDisconnect(conn)
+		return
+	}
+	OnDisconnect(conn)
+}
+
+func (h *TCPHooks) onDataOut(conn net.Conn, msg []byte) {
+	if h != nil && h.OnDataOut != nil {
+		h.OnDataOut(conn, msg)
+		return
+	}
+	OnDataOut(conn, msg)
+}
+
+func (h *TCPHooks) onProtocolError(conn *TcpConnection, err error) {
+	if h != nil && h.OnProtocolError != nil {
+		h.OnProtocolError(conn, err)
+		return
+	}
+	OnProtocolError(conn, err)
+}
+
+func (h *TCPHooks) onReject(conn net.Conn, reason error) {
+	if h != nil && h.OnReject != nil {
+		h.OnReject(conn, reason)
+		return
+	}
+	OnReject(conn, reason)
+}
+
+func (h *TCPHooks) onIdle(conn *TcpConnection) {
+	if h != nil && h.OnIdle != nil {
+		h.OnIdle(conn)
+		return
+	}
+	OnIdle(conn)
+}
+
+func (h *TCPHooks) onBufferIn(conn *TcpConnection, buf *Buffer) {
+	if h != nil && h.OnBufferIn != nil {
+		h.OnBufferIn(conn, buf)
+		return
+	}
+	if h != nil && h.OnDataIn != nil {
+		msg := make([]byte, buf.Len())
+		copy(msg, buf.Bytes())
+		buf.Release()
+		h.OnDataIn(conn, msg)
+		return
+	}
+	OnBufferIn(conn, buf)
+}
+
+// ===================================================================================
+// 具名TCP服务, 关闭后自动删除
+var (
+	tcpServersMu sync.RWMutex
+	tcpServers   = make(map[string]*tcpServer)
+)
+
+func registerTcpServer(s *tcpServer) error {
+	if s.name == "" {
+		return nil
+	}
+	tcpServersMu.Lock()
+	defer tcpServersMu.Unlock()
+	if _, ok := tcpServers[s.name]; ok {
+		return errors.New(fmt.Sprintf("tcp server [\"%s\"] already exists", s.name))
+	}
+	tcpServers[s.name] = s
+	return nil
+}
+
+func unregisterTcpServer(s *tcpServer) {
+	if s.name == "" {
+		return
+	}
+	tcpServersMu.Lock()
+	defer tcpServersMu.Unlock()
+	if tcpServers[s.name] == s {
+		delete(tcpServers, s.name)
+	}
+}
+
+func getTcpServer(name string) (server *TCPServer, ok bool) {
+	tcpServersMu.RLock()
+	defer tcpServersMu.RUnlock()
+	s, ok := tcpServers[name]
+	if !ok {
+		return nil, false
+	}
+	return &TCPServer{s: s}, true
+}
+
+// 按名称排序的具名TCP服务
+func getTcpServers() (servers []*TCPServer) {
+	tcpServersMu.RLock()
+	names := make([]string, 0, len(tcpServers))
+	for name := range tcpServers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		servers = append(servers, &TCPServer{s: tcpServers[name]})
+	}
+	tcpServersMu.RUnlock()
+	return
+}
+
+// 服务名称
+func (s *TCPServer) Name() string {
+	return s.s.name
+}
@@ -0,0 +1,92 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+var (
+	ErrTooManyConnections      = errors.New("too many connections")
+	ErrTooManyConnectionsPerIP = errors.New("too many connections from ip")
+	ErrIPDenied                = errors.New("ip denied")
+)
+
+// IP黑白名单, 支持CIDR和单个IP
+type ipFilter struct {
+	allow []*net.IPNet
+	deny  []*net.IPNet
+}
+
+func newIPFilter(allow, deny []string) (f *ipFilter, err error) {
+	if len(allow) == 0 && len(deny) == 0 {
+		return nil, nil
+	}
+	f = &ipFilter{}
+	if f.allow, err = parseCIDRs(allow); err != nil {
+		return nil, err
+	}
+	if f.deny, err = parseCIDRs(deny); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func parseCIDRs(addrs []string) (nets []*net.IPNet, err error) {
+	for _, addr := range addrs {
+		if !strings.Contains(addr, "/") {
+			ip := net.ParseIP(addr)
+			if ip == nil {
+				return nil, errors.New(fmt.Sprintf("invalid ip [\"%s\"]", addr))
+			}
+			bits := 8 * net.IPv4len
+			if ip.To4() == nil {
+				bits = 8 * net.IPv6len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, e := net.ParseCIDR(addr)
+		if e != nil {
+			return nil, e
+		}
+		nets = append(nets, n)
+	}
+	return
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// 黑名单优先; 白名单非空时只允许名单内的地址
+func (f *ipFilter) check(ip string) error {
+	if f == nil {
+		return nil
+	}
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+	if containsIP(f.deny, addr) {
+		return ErrIPDenied
+	}
+	if len(f.allow) > 0 && !containsIP(f.allow, addr) {
+		return ErrIPDenied
+	}
+	return nil
+}
+
+// 连接的对端IP, 非TCP连接返回空
+func remoteIP(conn net.Conn) string {
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP.String()
+	}
+	return ""
+}
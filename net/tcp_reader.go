@@ -1,67 +1,58 @@
 package net
 
 import (
-	"encoding/binary"
+	"bufio"
 	"io"
 
 	"github.com/xuhn/optimusprime/net/ratelimiter"
 )
 
 type reader struct {
-	r         io.Reader
-	buf       []byte
-	ratelimit *ratelimiter.RateLimit
+	r            *bufio.Reader
+	codec        Codec
+	maxFrameSize int
+	ratelimit    *ratelimiter.RateLimit
 }
 
-func newReader(r io.Reader) *reader {
+func newReader(r io.Reader, codec Codec) *reader {
+	if codec == nil {
+		codec = DefaultCodec
+	}
 	rtl := ratelimiter.NewRateLimit(defaultStrategy, defaultRate, defaultCapacity)
 	return &reader{
-		r:         r,
-		buf:       make([]byte, defaultPacketSize),
-		ratelimit: rtl,
+		r:            bufio.NewReaderSize(r, defaultPacketSize),
+		codec:        codec,
+		maxFrameSize: defaultMaxFrameSize,
+		ratelimit:    rtl,
 	}
 }
 
-func (r *reader) readPacket() (packet []byte, err error) {
-	//read head, get packet length
-	n, err := r.readHead()
+// 读取数据包到缓冲池内存, 编解码器不支持时读取后包装
+func (r *reader) readBuffer() (packet *Buffer, err error) {
+	if codec, ok := r.codec.(BufferCodec); ok {
+		packet, err = codec.ReadFrameBuffer(r.r, r.maxFrameSize)
+	} else {
+		var p []byte
+		if p, err = r.codec.ReadFrame(r.r, r.maxFrameSize); err == nil {
+			packet = wrapBuffer(p)
+		}
+	}
 	if err != nil {
 		return
 	}
-	// read body
 	if r.ratelimit != nil {
-		r.ratelimit.Stop(int64(n))
-	}
-	_, err = r.readBody(n)
-	if err != nil {
-		return
+		r.ratelimit.Stop(int64(packet.Len()))
 	}
-	packet = make([]byte, 0, n)
-	packet = append(packet, r.buf[:n]...)
 	return
 }
 
-func (r *reader) readHead() (hlen int, err error) {
-	n, err := r.readUint32BE()
+func (r *reader) readPacket() (packet []byte, err error) {
+	packet, err = r.codec.ReadFrame(r.r, r.maxFrameSize)
 	if err != nil {
-		return 0, err
+		return
 	}
-	return int(n), nil
-}
-
-func (r *reader) readUint32BE() (n uint32, err error) {
-	_, err = io.ReadFull(r.r, r.buf[:defaultHeadSize])
-	if err != nil {
-		return 0, err
+	if r.ratelimit != nil {
+		r.ratelimit.Stop(int64(len(packet)))
 	}
-	n = binary.BigEndian.Uint32(r.buf[:defaultHeadSize])
 	return
 }
-
-func (r *reader) readBody(blen int) (n int, err error) {
-	if blen > defaultPacketSize {
-		r.buf = make([]byte, blen)
-	}
-
-	return io.ReadFull(r.r, r.buf[:blen])
-}
@@ -0,0 +1,192 @@
+package net
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrConnectionNotFound = errors.New("connection not found")
+)
+
+// 连接上的业务数据, 如用户id, 会话, 分组标签
+type connMeta struct {
+	mu      sync.RWMutex
+	userId  string
+	session interface{}
+	tags    map[string]bool
+	values  map[string]interface{}
+}
+
+func (c *TcpConnection) SetUserId(userId string) {
+	c.meta.mu.Lock()
+	c.meta.userId = userId
+	c.meta.mu.Unlock()
+}
+
+func (c *TcpConnection) UserId() string {
+	c.meta.mu.RLock()
+	defer c.meta.mu.RUnlock()
+	return c.meta.userId
+}
+
+func (c *TcpConnection) SetSession(session interface{}) {
+	c.meta.mu.Lock()
+	c.meta.session = session
+	c.meta.mu.Unlock()
+}
+
+func (c *TcpConnection) Session() interface{} {
+	c.meta.mu.RLock()
+	defer c.meta.mu.RUnlock()
+	return c.meta.session
+}
+
+// 给连接打标签, 用于按分组推送
+func (c *TcpConnection) AddTag(tags ...string) {
+	c.meta.mu.Lock()
+	defer c.meta.mu.Unlock()
+	if c.meta.tags == nil {
+		c.meta.tags = make(map[string]bool)
+	}
+	for _, tag := range tags {
+		c.meta.tags[tag] = true
+	}
+}
+
+func (c *TcpConnection) RemoveTag(tags ...string) {
+	c.meta.mu.Lock()
+	defer c.meta.mu.Unlock()
+	for _, tag := range tags {
+		delete(c.meta.tags, tag)
+	}
+}
+
+func (c *TcpConnection) HasTag(tag string) bool {
+	c.meta.mu.RLock()
+	defer c.meta.mu.RUnlock()
+	return c.meta.tags[tag]
+}
+
+func (c *TcpConnection) Tags() (tags []string) {
+	c.meta.mu.RLock()
+	defer c.meta.mu.RUnlock()
+	tags = make([]string, 0, len(c.meta.tags))
+	for tag := range c.meta.tags {
+		tags = append(tags, tag)
+	}
+	return
+}
+
+// 保存自定义数据
+func (c *TcpConnection) SetValue(key string, value interface{}) {
+	c.meta.mu.Lock()
+	defer c.meta.mu.Unlock()
+	if c.meta.values == nil {
+		c.meta.values = make(map[string]interface{})
+	}
+	c.meta.values[key] = value
+}
+
+func (c *TcpConnection) Value(key string) (value interface{}, ok bool) {
+	c.meta.mu.RLock()
+	defer c.meta.mu.RUnlock()
+	value, ok = c.meta.values[key]
+	return
+}
+
+// ===================================================================================
+// 按id查找连接
+func (s *TCPServer) Connection(id uint64) (c *TcpConnection, ok bool) {
+	s.s.connectionMutex.Lock()
+	defer s.s.connectionMutex.Unlock()
+	c, ok = s.s.connections[id]
+	return
+}
+
+// 当前所有连接的快照
+func (s *TCPServer) Connections() []*TcpConnection {
+	return s.s.dumpConnections()
+}
+
+// 遍历连接, f返回false时停止; 遍历的是快照, f中可以安全地关闭连接或发送数据
+func (s *TCPServer) Range(f func(c *TcpConnection) bool) {
+	for _, c := range s.s.dumpConnections() {
+		if !f(c) {
+			return
+		}
+	}
+}
+
+// 查找用户的所有连接
+func (s *TCPServer) ConnectionsByUser(userId string) (connections []*TcpConnection) {
+	s.Range(func(c *TcpConnection) bool {
+		if c.UserId() == userId {
+			connections = append(connections, c)
+		}
+		return true
+	})
+	return
+}
+
+// 查找带有标签的所有连接
+func (s *TCPServer) ConnectionsByTag(tag string) (connections []*TcpConnection) {
+	s.Range(func(c *TcpConnection) bool {
+		if c.HasTag(tag) {
+			connections = append(connections, c)
+		}
+		return true
+	})
+	return
+}
+
+// 向指定连接推送数据, timeOut为写超时, 0不超时
+func (s *TCPServer) SendTo(id uint64, msg []byte, timeOut time.Duration) (err error) {
+	c, ok := s.Connection(id)
+	if !ok {
+		return ErrConnectionNotFound
+	}
+	_, err = c.SendTimeout(msg, timeOut)
+	return
+}
+
+// 向用户的所有连接推送数据, 返回发送成功的连接数
+func (s *TCPServer) SendToUser(userId string, msg []byte, timeOut time.Duration) int {
+	return sendToConnections(s.ConnectionsByUser(userId), msg, timeOut)
+}
+
+// 向带有标签的所有连接推送数据, 返回发送成功的连接数
+func (s *TCPServer) SendToTag(tag string, msg []byte, timeOut time.Duration) int {
+	return sendToConnections(s.ConnectionsByTag(tag), msg, timeOut)
+}
+
+// 向所有连接推送数据, 返回发送成功的连接数
+func (s *TCPServer) Broadcast(msg []byte, timeOut time.Duration) int {
+	return sendToConnections(s.s.dumpConnections(), msg, timeOut)
+}
+
+// 并发发送, 每个连接单独计算写超时, 慢连接不影响其他连接
+func sendToConnections(connections []*TcpConnection, msg []byte, timeOut time.Duration) int {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		sent int
+	)
+	for _, c := range connections {
+		if c.IsClosed() {
+			continue
+		}
+		wg.Add(1)
+		go func(c *TcpConnection) {
+			defer wg.Done()
+			if _, err := c.SendTimeout(msg, timeOut); err == nil {
+				mu.Lock()
+				sent++
+				mu.Unlock()
+			}
+		}(c)
+	}
+	wg.Wait()
+	return sent
+}
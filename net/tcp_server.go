@@ -1,16 +1,87 @@
 package net
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"net"
+	"os"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/xuhn/optimusprime/log"
+	"github.com/xuhn/optimusprime/net/ratelimiter"
 )
 
+var (
+	ErrServerClosed = errors.New("tcp server closed")
+)
+
+// TCP服务配置
+type TCPServerConfig struct {
+	// 服务名称, 非空时可通过TCPServerByName查找, 同名服务不能同时运行
+	Name string
+	// 钩子函数, 为空或字段为空时使用全局钩子函数
+	Hooks *TCPHooks
+	// 数据包编解码, 为空时使用DefaultCodec
+	Codec Codec
+	// 最大数据包长度, 0使用默认值(16M), 小于0不限制
+	MaxFrameSize int
+	// TLS配置, 为空时不启用TLS
+	TLS *TLSConfig
+	// 请求分发配置, 为空时每个请求启动一个goroutine处理
+	Dispatch *DispatchConfig
+	// 最大连接数, 0不限制
+	MaxConnections int
+	// 单个IP最大连接数, 0不限制
+	MaxConnectionsPerIP int
+	// 每秒accept的连接数, 0不限制; 超出时延迟accept, 新连接在内核队列中等待
+	AcceptRate float32
+	// accept限速的突发容量, 0时与AcceptRate相同
+	AcceptBurst int64
+	// IP白名单(CIDR或IP), 非空时只允许名单内的地址连接
+	Allow []string
+	// IP黑名单(CIDR或IP), 优先于白名单
+	Deny []string
+	// 读空闲超时, 超过该时间未收到任何数据则关闭连接, 0不超时
+	ReadIdleTimeout time.Duration
+	// 应用层心跳, 为空时不开启; Codec需支持控制帧
+	Heartbeat *HeartbeatConfig
+	// 异步合并发送, 为空时在调用方goroutine中同步发送
+	AsyncWrite *AsyncWriteConfig
+	// 使用缓冲池接收数据包, 数据包通过OnBufferIn传递, 处理完需调用Release
+	PooledBuffers bool
+	// Unix socket文件权限, 如0660, 0时不修改
+	UnixSocketMode os.FileMode
+}
+
 type tcpServer struct {
-	listener net.Listener
+	name         string
+	hooks        *TCPHooks
+	listener     net.Listener
+	codec        Codec
+	maxFrameSize int
+	idleTimeout  time.Duration
+	heartbeat    *HeartbeatConfig
+	asyncWrite   *AsyncWriteConfig
+	pooled       bool
+	tlsConfig    *tls.Config
+	certReloader *certReloader
+	dispatcher   *dispatcher
+
+	// 连接限制
+	maxConnections      int
+	maxConnectionsPerIP int
+	ipConnections       map[string]int
+	ipFilter            *ipFilter
+	acceptLimit         *ratelimiter.RateLimit
+
+	// 因协议错误被拒绝的数据包数
+	rejectedFrames uint64
+	// 被拒绝的连接数
+	rejectedConnections uint64
 
 	// About connection
 	maxConnnectionId uint64
@@ -22,85 +93,370 @@ type tcpServer struct {
 	stopWait sync.WaitGroup
 }
 
-func newTcpServer(listener net.Listener) *tcpServer {
-	return &tcpServer{
-		listener:    listener,
-		connections: make(map[uint64]*TcpConnection),
+// TCPServer 对外暴露的TCP服务句柄, 用于优雅关闭
+type TCPServer struct {
+	s *tcpServer
+}
+
+func newTcpServer(listener net.Listener, config *TCPServerConfig) (s *tcpServer, err error) {
+	if config == nil {
+		config = &TCPServerConfig{}
+	}
+	codec := config.Codec
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	// 开启心跳时才使用控制帧, 未开启时编解码格式不变
+	if config.Heartbeat != nil {
+		if codec, err = NewHeartbeatCodec(codec); err != nil {
+			return nil, err
+		}
+	}
+	s = &tcpServer{
+		name:                config.Name,
+		hooks:               config.Hooks,
+		listener:            listener,
+		codec:               codec,
+		maxFrameSize:        config.MaxFrameSize,
+		idleTimeout:         config.ReadIdleTimeout,
+		heartbeat:           config.Heartbeat,
+		asyncWrite:          config.AsyncWrite,
+		pooled:              config.PooledBuffers,
+		maxConnections:      config.MaxConnections,
+		maxConnectionsPerIP: config.MaxConnectionsPerIP,
+		ipConnections:       make(map[string]int),
+		connections:         make(map[uint64]*TcpConnection),
+	}
+	if err = chmodUnixSocket(listener, config.UnixSocketMode); err != nil {
+		return nil, err
 	}
+	if s.ipFilter, err = newIPFilter(config.Allow, config.Deny); err != nil {
+		return nil, err
+	}
+	if config.AcceptRate > 0 {
+		burst := config.AcceptBurst
+		if burst <= 0 {
+			burst = int64(config.AcceptRate)
+			if burst < 1 {
+				burst = 1
+			}
+		}
+		s.acceptLimit = ratelimiter.NewRateLimit("token", config.AcceptRate, burst)
+	}
+	if config.TLS != nil {
+		if s.tlsConfig, s.certReloader, err = newServerTLSConfig(config.TLS); err != nil {
+			return nil, err
+		}
+	}
+	if err = registerTcpServer(s); err != nil {
+		s.closeCertReloader()
+		return nil, err
+	}
+	s.dispatcher = newDispatcher(config.Dispatch)
+	return
 }
 
 func (s *tcpServer) serve() (err error) {
 	log.DEBUGF("server start service at %s", s.listener.Addr())
 	for {
+		if s.acceptLimit != nil {
+			s.acceptLimit.Stop(1)
+		}
 		c, err := s.listener.Accept()
 		if err != nil {
+			if s.isStopping() {
+				return ErrServerClosed
+			}
 			log.ERRORF("Accept fail:%v", err)
 			fmt.Println("Accept fail:", err)
 			break
 		}
 		connection, err := s.newConnection(c)
+		if err != nil {
+			s.reject(c, err)
+			continue
+		}
+		// 关闭过程中新建立的连接直接关闭, 未调用OnConnect, 因此也不调用OnDisconnect
+		if s.isStopping() {
+			connection.closeWithoutHooks()
+			s.delConnection(connection)
+			return ErrServerClosed
+		}
 		log.DEBUGF("new server connection [ %s -> %s ]", c.RemoteAddr(), c.LocalAddr())
-		// 钩子函数，用于业务server嵌入连接建立时的逻辑
-		OnConnect(connection)
 		// 每个连接启动一个goroutine处理
-		go s.serveConnection(connection)
+		go func() {
+			// TLS握手在连接自己的goroutine中完成, 不阻塞accept
+			if !s.handshake(connection) {
+				return
+			}
+			if s.asyncWrite != nil {
+				connection.EnableAsyncWrite(*s.asyncWrite)
+			}
+			// 钩子函数，用于业务server嵌入连接建立时的逻辑
+			s.hooks.onConnect(connection)
+			if s.heartbeat != nil {
+				connection.StartHeartbeat(*s.heartbeat)
+			}
+			s.serveConnection(connection)
+		}()
 	}
 	return
 }
 
 func (s *tcpServer) newConnection(conn net.Conn) (c *TcpConnection, err error) {
-	c = newTcpConnection(conn)
-	if err = c.SetKeepAlive(defaultKeepAlivePeriod); err != nil {
+	if err = s.ipFilter.check(remoteIP(conn)); err != nil {
+		return nil, err
+	}
+	if s.tlsConfig != nil {
+		c = newTcpConnection(tls.Server(conn, s.tlsConfig), s.codec)
+		c.rawConn = conn
+	} else {
+		c = newTcpConnection(conn, s.codec)
+	}
+	c.hooks = s.hooks
+	c.SetMaxFrameSize(s.maxFrameSize)
+	c.SetReadIdleTimeout(s.idleTimeout)
+	if err = s.addConnection(c); err != nil {
+		return nil, err
+	}
+	if e := c.SetKeepAlive(defaultKeepAlivePeriod); e != nil {
+		log.WARNF("connection [ %s -> %s ] set keepalive fail:%v", conn.RemoteAddr(), conn.LocalAddr(), e)
+	}
+	return
+}
+
+// 拒绝连接, 直接关闭, 不调用OnConnect和OnDisconnect
+func (s *tcpServer) reject(conn net.Conn, reason error) {
+	atomic.AddUint64(&s.rejectedConnections, 1)
+	log.WARNF("reject connection [ %s -> %s ]: %v", conn.RemoteAddr(), conn.LocalAddr(), reason)
+	// 钩子函数，用于业务server嵌入拒绝连接时的逻辑
+	s.hooks.onReject(conn, reason)
+	conn.Close()
+}
+
+// TLS握手, 失败时关闭连接; 握手前未调用OnConnect, 因此也不调用OnDisconnect
+func (s *tcpServer) handshake(c *TcpConnection) bool {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return true
+	}
+	if err := s.tlsHandshake(c, tc); err != nil {
+		log.WARNF("connection [ %s -> %s ] tls handshake fail:%v", c.conn.RemoteAddr(), c.conn.LocalAddr(), err)
+		c.closeWithoutHooks()
+		s.delConnection(c)
+		return false
+	}
+	return true
+}
+
+// 握手超时为defaultHandshakeTimeout; 关闭服务时stopRead设置的deadline使握手立即失败
+func (s *tcpServer) tlsHandshake(c *TcpConnection, tc *tls.Conn) (err error) {
+	if err = tc.SetDeadline(time.Now().Add(defaultHandshakeTimeout)); err != nil {
 		return
 	}
-	s.addConnection(c)
+	// 与stopRead并发时, 保证停止读取的deadline不被覆盖
+	if atomic.LoadInt32(&c.readStopped) != 0 {
+		return ErrServerClosed
+	}
+	if err = tc.Handshake(); err != nil {
+		return
+	}
+	if err = tc.SetDeadline(noDeadline); err != nil {
+		return
+	}
+	if atomic.LoadInt32(&c.readStopped) != 0 {
+		return ErrServerClosed
+	}
 	return
 }
 
-func (s *tcpServer) addConnection(c *TcpConnection) {
+func (s *tcpServer) addConnection(c *TcpConnection) error {
 	s.connectionMutex.Lock()
 	defer s.connectionMutex.Unlock()
+	if s.maxConnections > 0 && len(s.connections) >= s.maxConnections {
+		return ErrTooManyConnections
+	}
+	if ip := remoteIP(c.rawConn); ip != "" {
+		if s.maxConnectionsPerIP > 0 && s.ipConnections[ip] >= s.maxConnectionsPerIP {
+			return ErrTooManyConnectionsPerIP
+		}
+		s.ipConnections[ip]++
+	}
 	s.connections[c.id] = c
 	s.stopWait.Add(1)
+	return nil
 }
 
 func (s *tcpServer) serveConnection(c *TcpConnection) {
+	// 钩子函数，用于业务server嵌入接收数据时的逻辑
+	cd := s.dispatcher.newConnDispatcher(c, func(c *TcpConnection, req []byte, buf *Buffer) {
+		if buf != nil {
+			c.hooks.onBufferIn(c, buf)
+			return
+		}
+		c.hooks.onDataIn(c, req)
+	})
 	for {
-		req, err := c.Receive()
+		req, buf, err := s.receive(c)
 		if err != nil {
+			if isProtocolError(err) {
+				atomic.AddUint64(&s.rejectedFrames, 1)
+				log.WARNF("connection [ %s -> %s ] protocol error: %v", c.conn.RemoteAddr(), c.conn.LocalAddr(), err)
+			}
+			cd.close()
+			if isTimeoutError(err) && !s.isStopping() && !c.IsClosed() {
+				log.DEBUGF("connection [ %s -> %s ] read idle timeout", c.conn.RemoteAddr(), c.conn.LocalAddr())
+				c.closeIdle()
+			}
+			if s.isStopping() {
+				// 优雅关闭: 等待该连接上正在处理的请求完成后再关闭连接
+				c.requestWait.Wait()
+			}
+			c.Close()
 			log.DEBUGF("connection [ %s -> %s ] is closed", c.conn.RemoteAddr(), c.conn.LocalAddr())
 			s.delConnection(c)
 			return
 		}
-		// 每个请求启动一个goroutine处理
-		// 钩子函数，用于业务server嵌入接收数据时的逻辑
-		go OnDataIn(c, req)
+		// 按分发配置处理请求, 队列满且策略为关闭连接时下次读取返回错误
+		cd.dispatch(req, buf)
 	}
 }
 
+func (s *tcpServer) receive(c *TcpConnection) (req []byte, buf *Buffer, err error) {
+	if !s.pooled {
+		req, err = c.receive()
+		return
+	}
+	if buf, err = c.receiveBuffer(); err != nil {
+		return
+	}
+	return buf.Bytes(), buf, nil
+}
+
 func (s *tcpServer) lenConnection() int {
+	s.connectionMutex.Lock()
+	defer s.connectionMutex.Unlock()
 	return len(s.connections)
 }
 
+func (s *tcpServer) isStopping() bool {
+	return atomic.LoadInt32(&s.stopFlag) != 0
+}
+
 func (s *tcpServer) stop() bool {
 	if atomic.CompareAndSwapInt32(&s.stopFlag, 0, 1) {
+		unregisterTcpServer(s)
 		s.listener.Close()
+		s.closeCertReloader()
 		s.closeConnections()
 		s.stopWait.Wait()
+		s.dispatcher.close()
 		return true
 	}
 	return false
 }
 
+// 优雅关闭: 停止accept, 停止读取新的请求, 等待正在处理的请求完成;
+// ctx超时或取消后强制关闭剩余连接
+func (s *tcpServer) shutdown(ctx context.Context) (err error) {
+	if !atomic.CompareAndSwapInt32(&s.stopFlag, 0, 1) {
+		return ErrServerClosed
+	}
+	unregisterTcpServer(s)
+	s.listener.Close()
+	s.closeCertReloader()
+	// 唤醒阻塞在读上的连接, 不再接收新的请求
+	for _, c := range s.dumpConnections() {
+		c.stopRead()
+	}
+
+	finished := make(chan bool)
+	go func() {
+		s.stopWait.Wait()
+		s.dispatcher.close()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-ctx.Done():
+		s.closeConnections()
+		err = ctx.Err()
+	}
+	return
+}
+
+func (s *tcpServer) closeCertReloader() {
+	if s.certReloader != nil {
+		s.certReloader.close()
+	}
+}
+
 func (s *tcpServer) delConnection(c *TcpConnection) {
 	s.connectionMutex.Lock()
 	defer s.connectionMutex.Unlock()
+	if _, ok := s.connections[c.id]; !ok {
+		return
+	}
 	delete(s.connections, c.id)
+	if ip := remoteIP(c.rawConn); ip != "" {
+		if s.ipConnections[ip]--; s.ipConnections[ip] <= 0 {
+			delete(s.ipConnections, ip)
+		}
+	}
 	s.stopWait.Done()
 }
 
-func (s *tcpServer) closeConnections() {
+func (s *tcpServer) dumpConnections() (connections []*TcpConnection) {
+	s.connectionMutex.Lock()
+	defer s.connectionMutex.Unlock()
+	connections = make([]*TcpConnection, 0, len(s.connections))
 	for _, connection := range s.connections {
+		connections = append(connections, connection)
+	}
+	return
+}
+
+func (s *tcpServer) closeConnections() {
+	for _, connection := range s.dumpConnections() {
 		connection.Close()
 	}
 }
+
+// 监听地址
+func (s *TCPServer) Addr() net.Addr {
+	return s.s.listener.Addr()
+}
+
+// 当前连接数
+func (s *TCPServer) LenConnections() int {
+	return s.s.lenConnection()
+}
+
+// 因协议错误被拒绝的数据包数
+func (s *TCPServer) RejectedFrames() uint64 {
+	return atomic.LoadUint64(&s.s.rejectedFrames)
+}
+
+// 请求分发统计
+func (s *TCPServer) DispatchStats() DispatchStats {
+	return s.s.dispatcher.stats()
+}
+
+// 因连接数限制或IP名单被拒绝的连接数
+func (s *TCPServer) RejectedConnections() uint64 {
+	return atomic.LoadUint64(&s.s.rejectedConnections)
+}
+
+// 优雅关闭, 等待正在处理的请求完成, ctx到期后强制关闭
+func (s *TCPServer) Shutdown(ctx context.Context) error {
+	return s.s.shutdown(ctx)
+}
+
+// 立即关闭所有连接
+func (s *TCPServer) Close() error {
+	if !s.s.stop() {
+		return ErrServerClosed
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 启动TLS服务并建立一个不发送ClientHello的连接, 握手一直挂起
+func newHandshakeHangingServer(t *testing.T) (s *tcpServer, client net.Conn) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, err = newTcpServer(listener, nil); err != nil {
+		t.Fatal(err)
+	}
+	s.tlsConfig = &tls.Config{}
+	go s.serve()
+	if client, err = net.Dial("tcp", listener.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	for deadline := time.Now().Add(time.Second); s.lenConnection() == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("connection not accepted")
+		}
+	}
+	return
+}
+
+func Test_ShutdownDuringTLSHandshake(t *testing.T) {
+	s, client := newHandshakeHangingServer(t)
+	defer client.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	start := time.Now()
+	if err := s.shutdown(ctx); err != nil {
+		t.Fatalf("shutdown returned %v", err)
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("shutdown waited %v for the stalled handshake", d)
+	}
+
+	// 强制关闭与握手失败同时关闭连接, 只关闭一次
+	s, client = newHandshakeHangingServer(t)
+	defer client.Close()
+	s.stop()
+	if n := s.lenConnection(); n != 0 {
+		t.Errorf("%d connections left after stop", n)
+	}
+}
+
+func Test_AcceptWhileStopping(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	disconnected := make(chan bool, 1)
+	s, err := newTcpServer(listener, &TCPServerConfig{Hooks: &TCPHooks{
+		OnDisconnect: func(conn *TcpConnection) { disconnected <- true },
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 模拟accept之后关闭开始
+	atomic.StoreInt32(&s.stopFlag, 1)
+	served := make(chan error, 1)
+	go func() { served <- s.serve() }()
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err = <-served; err != ErrServerClosed {
+		t.Fatalf("serve returned %v", err)
+	}
+	if s.lenConnection() != 0 {
+		t.Error("connection accepted while stopping not removed")
+	}
+	select {
+	case <-disconnected:
+		t.Error("OnDisconnect called without OnConnect")
+	case <-time.After(20 * time.Millisecond):
+	}
+}
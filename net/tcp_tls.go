@@ -0,0 +1,337 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/xuhn/optimusprime/common"
+	"github.com/xuhn/optimusprime/log"
+)
+
+const (
+	defaultCertReloadInterval = 30 * time.Second
+	defaultHandshakeTimeout   = 10 * time.Second
+)
+
+// TLS配置, 服务端和客户端共用
+type TLSConfig struct {
+	// 证书和私钥文件, 服务端必填; 客户端用于mTLS
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// 服务端: 校验客户端证书的CA; 客户端: 校验服务端证书的CA, 为空使用系统CA
+	CAFile string `json:"ca_file"`
+	// 服务端: 是否要求并校验客户端证书(mTLS)
+	ClientAuth bool `json:"client_auth"`
+	// 客户端: 校验的服务端名称, 为空时使用地址中的host
+	ServerName string `json:"server_name"`
+	// 客户端: 不校验服务端证书, 仅用于测试
+	InsecureSkipVerify bool `json:"insecure_skip_verify"`
+	// 证书文件变化检查周期, 0使用默认值30s, 小于0不检查
+	ReloadInterval time.Duration `json:"-"`
+}
+
+// 从配置文件读取TLS配置, key如"tcp.tls"
+func tlsConfigFromConfig(key string) (config *TLSConfig, err error) {
+	value, err := common.GetConfigByKey(key)
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	config = &TLSConfig{}
+	err = json.Unmarshal(data, config)
+	return
+}
+
+// 证书热加载, 定时检查证书文件修改时间, 变化后重新加载
+type certReloader struct {
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+	stop    chan bool
+}
+
+func newCertReloader(certFile, keyFile string, interval time.Duration) (r *certReloader, err error) {
+	r = &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		stop:     make(chan bool),
+	}
+	if err = r.reload(); err != nil {
+		return nil, err
+	}
+	if interval == 0 {
+		interval = defaultCertReloadInterval
+	}
+	if interval > 0 {
+		go r.watch(interval)
+	}
+	return
+}
+
+func (r *certReloader) lastModTime() (t time.Time, err error) {
+	for _, f := range []string{r.certFile, r.keyFile} {
+		info, e := os.Stat(f)
+		if e != nil {
+			return t, e
+		}
+		if info.ModTime().After(t) {
+			t = info.ModTime()
+		}
+	}
+	return
+}
+
+func (r *certReloader) reload() (err error) {
+	modTime, err := r.lastModTime()
+	if err != nil {
+		return
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return
+	}
+	r.mu.Lock()
+	r.cert = &cert
+	r.modTime = modTime
+	r.mu.Unlock()
+	return
+}
+
+func (r *certReloader) watch(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			modTime, err := r.lastModTime()
+			if err != nil {
+				log.ERRORF("check certificate [%s] fail:%v", r.certFile, err)
+				continue
+			}
+			r.mu.RLock()
+			changed := !modTime.Equal(r.modTime)
+			r.mu.RUnlock()
+			if !changed {
+				continue
+			}
+			// 加载失败时继续使用旧证书
+			if err = r.reload(); err != nil {
+				log.ERRORF("reload certificate [%s] fail:%v", r.certFile, err)
+				continue
+			}
+			log.INFOF("reload certificate [%s] success", r.certFile)
+		case <-r.stop:
+			return
+		}
+	}
+}
+
+func (r *certReloader) close() {
+	close(r.stop)
+}
+
+func (r *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func (r *certReloader) getClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.cert, nil
+}
+
+func loadCertPool(caFile string) (pool *x509.CertPool, err error) {
+	data, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return
+	}
+	pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New(fmt.Sprintf("no certificate found in [\"%s\"]", caFile))
+	}
+	return
+}
+
+// 生成服务端tls配置
+func newServerTLSConfig(config *TLSConfig) (conf *tls.Config, reloader *certReloader, err error) {
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, nil, errors.New("tls cert_file and key_file are required")
+	}
+	if reloader, err = newCertReloader(config.CertFile, config.KeyFile, config.ReloadInterval); err != nil {
+		return
+	}
+	conf = &tls.Config{
+		GetCertificate: reloader.getCertificate,
+	}
+	if config.CAFile != "" {
+		if conf.ClientCAs, err = loadCertPool(config.CAFile); err != nil {
+			reloader.close()
+			return nil, nil, err
+		}
+		conf.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	if config.ClientAuth {
+		conf.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return
+}
+
+// 生成客户端tls配置
+func newClientTLSConfig(config *TLSConfig) (conf *tls.Config, reloader *certReloader, err error) {
+	conf = &tls.Config{
+		ServerName:         config.ServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if config.CAFile != "" {
+		if conf.RootCAs, err = loadCertPool(config.CAFile); err != nil {
+			return nil, nil, err
+		}
+	}
+	if config.CertFile != "" && config.KeyFile != "" {
+		if reloader, err = newCertReloader(config.CertFile, config.KeyFile, config.ReloadInterval); err != nil {
+			return nil, nil, err
+		}
+		conf.GetClientCertificate = reloader.getClientCertificate
+	}
+	return
+}
+
+// ===================================================================================
+// 客户端按地址配置TLS
+type clientTLS struct {
+	conf *tls.Config
+	// 通过setClientTLS创建的证书加载器, 替换配置时关闭
+	reloader *certReloader
+}
+
+var (
+	clientTLSMu sync.RWMutex
+	clientTLSs  = make(map[string]*clientTLS)
+)
+
+// 设置地址的TLS配置, config为空时取消TLS
+func setClientTLS(remote_addr string, config *TLSConfig) (err error) {
+	var conf *tls.Config
+	var reloader *certReloader
+	if config != nil {
+		if conf, reloader, err = newClientTLSConfig(config); err != nil {
+			return
+		}
+	}
+	setClientTLSConfig(remote_addr, conf, reloader)
+	return
+}
+
+func setClientTLSConfig(remote_addr string, conf *tls.Config, reloader *certReloader) {
+	conf = clientTLSForAddr(conf, remote_addr)
+	clientTLSMu.Lock()
+	old, ok := clientTLSs[remote_addr]
+	if conf == nil {
+		delete(clientTLSs, remote_addr)
+	} else {
+		clientTLSs[remote_addr] = &clientTLS{conf: conf, reloader: reloader}
+	}
+	clientTLSMu.Unlock()
+	if ok && old.reloader != nil {
+		old.reloader.close()
+	}
+	// 已建立的连接需要关闭
+	closeClientTcpConnection(remote_addr)
+}
+
+// ServerName为空时使用地址的host
+func clientTLSForAddr(conf *tls.Config, remote_addr string) *tls.Config {
+	if conf != nil && conf.ServerName == "" {
+		if host, _, e := net.SplitHostPort(remote_addr); e == nil {
+			conf = conf.Clone()
+			conf.ServerName = host
+		}
+	}
+	return conf
+}
+
+// 通过ctx指定的TLS配置, 优先于按地址的配置, 用于upstream等有独立TLS配置的调用方
+// 连接池按tag区分, 不同配置的连接不会混用
+type clientTLSContext struct {
+	tag  string
+	conf *tls.Config
+}
+
+type clientTLSContextKey struct{}
+
+func withClientTLS(ctx context.Context, tag string, conf *tls.Config) context.Context {
+	return context.WithValue(ctx, clientTLSContextKey{}, &clientTLSContext{tag: tag, conf: conf})
+}
+
+func clientTLSFromContext(ctx context.Context) *clientTLSContext {
+	t, _ := ctx.Value(clientTLSContextKey{}).(*clientTLSContext)
+	return t
+}
+
+// 连接使用的TLS配置, 为空时不使用TLS
+func clientTLSConfig(ctx context.Context, remote_addr string) *tls.Config {
+	if t := clientTLSFromContext(ctx); t != nil {
+		return t.conf
+	}
+	return getClientTLS(remote_addr)
+}
+
+func getClientTLS(remote_addr string) *tls.Config {
+	clientTLSMu.RLock()
+	defer clientTLSMu.RUnlock()
+	if c, ok := clientTLSs[remote_addr]; ok {
+		return c.conf
+	}
+	return nil
+}
+
+// tls握手, 超时时间取deadline和defaultHandshakeTimeout中较早的
+func tlsHandshake(conn *tls.Conn, deadline time.Time) (err error) {
+	if max := time.Now().Add(defaultHandshakeTimeout); deadline.IsZero() || deadline.After(max) {
+		deadline = max
+	}
+	if err = conn.SetDeadline(deadline); err != nil {
+		return
+	}
+	if err = conn.Handshake(); err != nil {
+		return
+	}
+	return conn.SetDeadline(noDeadline)
+}
+
+// ===================================================================================
+// TLS连接状态, 非TLS连接返回false
+func (c *TcpConnection) TLSConnectionState() (state tls.ConnectionState, ok bool) {
+	tc, ok := c.conn.(*tls.Conn)
+	if !ok {
+		return
+	}
+	return tc.ConnectionState(), true
+}
+
+// 对端证书链, 第一个为对端证书; 服务端配置CAFile时已经过CA校验
+// 非TLS连接或对端未提供证书时返回nil
+func (c *TcpConnection) PeerCertificates() []*x509.Certificate {
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+	return state.PeerCertificates
+}
@@ -0,0 +1,85 @@
+package net
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Unix socket地址格式: unix:/path/to/server.sock, 端口参数被忽略
+const unixAddrPrefix = "unix:"
+
+var (
+	ErrUnixSocketInUse = errors.New("unix socket in use")
+	ErrNotUnixSocket   = errors.New("not a unix socket connection")
+)
+
+// Unix socket对端进程的凭证
+type PeerCred struct {
+	Pid int32
+	Uid uint32
+	Gid uint32
+}
+
+func isUnixAddr(addr string) bool {
+	return strings.HasPrefix(addr, unixAddrPrefix)
+}
+
+// 拨号使用的网络类型和地址
+func dialAddr(network, address string) (string, string) {
+	if isUnixAddr(address) {
+		return "unix", strings.TrimPrefix(address, unixAddrPrefix)
+	}
+	return network, address
+}
+
+// 监听Unix socket, 已存在的socket文件无进程监听时先删除
+func listenUnix(path string) (listener net.Listener, err error) {
+	if len(path) <= 0 {
+		err = errors.New("unix socket path is empty")
+		return
+	}
+	if err = removeStaleSocket(path); err != nil {
+		return
+	}
+	return net.Listen("unix", path)
+}
+
+func removeStaleSocket(path string) error {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.Mode()&os.ModeSocket == 0 {
+		return errors.New(fmt.Sprintf("[\"%s\"] exists and is not a socket", path))
+	}
+	// 能连上说明有进程在监听, 不能删除
+	if conn, e := net.DialTimeout("unix", path, time.Second); e == nil {
+		conn.Close()
+		return ErrUnixSocketInUse
+	}
+	return os.Remove(path)
+}
+
+// 设置Unix socket文件权限, 非Unix socket监听或mode为0时不处理
+func chmodUnixSocket(listener net.Listener, mode os.FileMode) error {
+	if _, ok := listener.(*net.UnixListener); !ok || mode == 0 {
+		return nil
+	}
+	return os.Chmod(listener.Addr().String(), mode)
+}
+
+// Unix socket连接对端进程的pid/uid/gid, 非Unix socket连接返回ErrNotUnixSocket
+func (c *TcpConnection) PeerCred() (cred *PeerCred, err error) {
+	conn, ok := c.rawConn.(*net.UnixConn)
+	if !ok {
+		return nil, ErrNotUnixSocket
+	}
+	return getPeerCred(conn)
+}
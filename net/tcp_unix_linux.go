@@ -0,0 +1,26 @@
+//go:build linux
+// +build linux
+
+package net
+
+import (
+	"net"
+	"syscall"
+)
+
+func getPeerCred(conn *net.UnixConn) (cred *PeerCred, err error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return
+	}
+	var ucred *syscall.Ucred
+	if e := raw.Control(func(fd uintptr) {
+		ucred, err = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); e != nil {
+		return nil, e
+	}
+	if err != nil {
+		return
+	}
+	return &PeerCred{Pid: ucred.Pid, Uid: ucred.Uid, Gid: ucred.Gid}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package net
+
+import (
+	"errors"
+	"net"
+)
+
+func getPeerCred(conn *net.UnixConn) (cred *PeerCred, err error) {
+	return nil, errors.New("peer credentials not supported on this platform")
+}
@@ -0,0 +1,416 @@
+package net
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xuhn/optimusprime/common"
+	"github.com/xuhn/optimusprime/log"
+)
+
+// 负载均衡策略
+const (
+	BalanceRoundRobin     = "round_robin"
+	BalanceWeighted       = "weighted"
+	BalanceLeastInflight  = "least_inflight"
+	BalanceConsistentHash = "consistent_hash"
+)
+
+const (
+	defaultResolveInterval = 30 * time.Second
+	defaultEjectDuration   = 30 * time.Second
+	hashReplicas           = 100
+)
+
+var (
+	ErrUpstreamNotFound = errors.New("upstream not found")
+	ErrNoEndpoint       = errors.New("upstream has no endpoint")
+)
+
+// 后端地址
+type Endpoint struct {
+	Addr   string `json:"addr"` // host:port
+	Weight int    `json:"weight"`
+}
+
+// 服务发现接口, 返回服务名对应的后端地址列表
+type Resolver interface {
+	Resolve(name string) ([]Endpoint, error)
+}
+
+// upstream配置
+type UpstreamConfig struct {
+	// 负载均衡策略, 默认round_robin
+	Balancer string `json:"balancer"`
+	// 静态后端地址, 设置Resolver时作为初始地址
+	Endpoints []Endpoint `json:"endpoints"`
+	// 服务发现, 为空时只使用Endpoints
+	Resolver Resolver `json:"-"`
+	// 服务发现刷新周期, 默认30s
+	ResolveInterval time.Duration `json:"-"`
+	// 连续失败MaxFails次后摘除该地址, 0不摘除
+	MaxFails int `json:"max_fails"`
+	// 摘除时长, 默认30s
+	EjectDuration time.Duration `json:"-"`
+	// 访问后端使用的TLS配置, 为空时不启用; ServerName为空时使用各地址的host
+	// 只作用于该upstream的请求, 优先于SetTCPClientTLS的按地址配置, 连接池与其他请求分开
+	TLS *TLSConfig `json:"tls"`
+}
+
+type upstreamEndpoint struct {
+	Endpoint
+	// upstream配置了TLS时该地址使用的配置
+	tlsConfig     *tls.Config
+	inflight      int64
+	fails         int32
+	ejectedUntil  int64
+	currentWeight int
+}
+
+type hashNode struct {
+	hash uint32
+	ep   *upstreamEndpoint
+}
+
+type upstream struct {
+	name   string
+	config UpstreamConfig
+
+	tlsConfig    *tls.Config
+	certReloader *certReloader
+
+	mu        sync.Mutex
+	endpoints []*upstreamEndpoint
+	ring      []hashNode
+	next      uint64
+	stop      chan bool
+}
+
+var (
+	upstreamsMu sync.RWMutex
+	upstreams   = make(map[string]*upstream)
+)
+
+func registerUpstream(name string, config UpstreamConfig) (err error) {
+	switch config.Balancer {
+	case "":
+		config.Balancer = BalanceRoundRobin
+	case BalanceRoundRobin, BalanceWeighted, BalanceLeastInflight, BalanceConsistentHash:
+	default:
+		return errors.New(fmt.Sprintf("unknown balancer [\"%s\"]", config.Balancer))
+	}
+	if config.ResolveInterval <= 0 {
+		config.ResolveInterval = defaultResolveInterval
+	}
+	if config.EjectDuration <= 0 {
+		config.EjectDuration = defaultEjectDuration
+	}
+	u := &upstream{
+		name:   name,
+		config: config,
+		stop:   make(chan bool),
+	}
+	if config.TLS != nil {
+		if u.tlsConfig, u.certReloader, err = newClientTLSConfig(config.TLS); err != nil {
+			return
+		}
+	}
+	u.setEndpoints(config.Endpoints)
+	if config.Resolver != nil {
+		if err = u.resolve(); err != nil && len(config.Endpoints) == 0 {
+			u.close()
+			return
+		}
+		err = nil
+		go u.resolveServe()
+	}
+
+	upstreamsMu.Lock()
+	old, ok := upstreams[name]
+	upstreams[name] = u
+	upstreamsMu.Unlock()
+	if ok {
+		old.close()
+	}
+	return
+}
+
+func (u *upstream) close() {
+	close(u.stop)
+	if u.certReloader != nil {
+		u.certReloader.close()
+	}
+	u.mu.Lock()
+	for _, ep := range u.endpoints {
+		u.closeEndpoint(ep)
+	}
+	u.mu.Unlock()
+}
+
+// upstream的TLS配置只用于该upstream, 连接池按upstream区分, 不影响其他访问同一地址的请求
+func (u *upstream) tlsTag() string {
+	return "upstream:" + u.name
+}
+
+// 关闭不再使用的地址上该upstream的空闲连接
+func (u *upstream) closeEndpoint(ep *upstreamEndpoint) {
+	if ep.tlsConfig != nil {
+		clientPool.closeIdleKey(clientPoolKey(withClientTLS(context.Background(), u.tlsTag(), ep.tlsConfig), ep.Addr))
+	}
+}
+
+func getUpstream(name string) (*upstream, error) {
+	upstreamsMu.RLock()
+	defer upstreamsMu.RUnlock()
+	if u, ok := upstreams[name]; ok {
+		return u, nil
+	}
+	return nil, ErrUpstreamNotFound
+}
+
+// 从配置文件加载upstream, 配置格式:
+// "tcp": {"upstreams": {"name": {"balancer": "weighted", "max_fails": 3, "eject_time": 30,
+// "endpoints": [{"addr": "127.0.0.1:9000", "weight": 1}]}}}
+func loadUpstreamsFromConfig() (err error) {
+	value, err := common.GetConfigByKey("tcp.upstreams")
+	if err != nil {
+		return
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return
+	}
+	configs := make(map[string]struct {
+		UpstreamConfig
+		EjectTime int `json:"eject_time"`
+	})
+	if err = json.Unmarshal(data, &configs); err != nil {
+		return
+	}
+	for name, config := range configs {
+		config.UpstreamConfig.EjectDuration = time.Duration(config.EjectTime) * time.Second
+		if err = registerUpstream(name, config.UpstreamConfig); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (u *upstream) setEndpoints(endpoints []Endpoint) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	// 保留已有地址的状态
+	old := make(map[string]*upstreamEndpoint)
+	for _, ep := range u.endpoints {
+		old[ep.Addr] = ep
+	}
+	eps := make([]*upstreamEndpoint, 0, len(endpoints))
+	for _, e := range endpoints {
+		if e.Weight <= 0 {
+			e.Weight = 1
+		}
+		ep, ok := old[e.Addr]
+		if ok {
+			delete(old, e.Addr)
+		} else {
+			ep = &upstreamEndpoint{tlsConfig: clientTLSForAddr(u.tlsConfig, e.Addr)}
+		}
+		ep.Endpoint = e
+		eps = append(eps, ep)
+	}
+	u.endpoints = eps
+	for _, ep := range old {
+		u.closeEndpoint(ep)
+	}
+
+	ring := make([]hashNode, 0, len(eps)*hashReplicas)
+	for _, ep := range eps {
+		for i := 0; i < hashReplicas*ep.Weight; i++ {
+			h := hashKey(ep.Addr + "#" + strconv.Itoa(i))
+			ring = append(ring, hashNode{hash: h, ep: ep})
+		}
+	}
+	sort.Slice(ring, func(i, j int) bool { return ring[i].hash < ring[j].hash })
+	u.ring = ring
+}
+
+func (u *upstream) resolve() (err error) {
+	endpoints, err := u.config.Resolver.Resolve(u.name)
+	if err != nil {
+		log.ERRORF("resolve upstream[%s] fail:%v", u.name, err)
+		return
+	}
+	u.setEndpoints(endpoints)
+	return
+}
+
+func (u *upstream) resolveServe() {
+	ticker := time.NewTicker(u.config.ResolveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			u.resolve()
+		case <-u.stop:
+			return
+		}
+	}
+}
+
+// 选择后端地址, 全部被摘除时忽略摘除状态
+func (u *upstream) pick(key string) (ep *upstreamEndpoint, err error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if len(u.endpoints) == 0 {
+		return nil, ErrNoEndpoint
+	}
+	now := time.Now().UnixNano()
+	healthy := make([]*upstreamEndpoint, 0, len(u.endpoints))
+	for _, ep := range u.endpoints {
+		if atomic.LoadInt64(&ep.ejectedUntil) <= now {
+			healthy = append(healthy, ep)
+		}
+	}
+	ignoreEject := len(healthy) == 0
+	if ignoreEject {
+		healthy = u.endpoints
+	}
+
+	switch u.config.Balancer {
+	case BalanceWeighted:
+		// 平滑加权轮询
+		total := 0
+		for _, e := range healthy {
+			e.currentWeight += e.Weight
+			total += e.Weight
+			if ep == nil || e.currentWeight > ep.currentWeight {
+				ep = e
+			}
+		}
+		ep.currentWeight -= total
+	case BalanceLeastInflight:
+		start := rand.Intn(len(healthy))
+		for i := range healthy {
+			e := healthy[(start+i)%len(healthy)]
+			if ep == nil || atomic.LoadInt64(&e.inflight) < atomic.LoadInt64(&ep.inflight) {
+				ep = e
+			}
+		}
+	case BalanceConsistentHash:
+		h := hashKey(key)
+		i := sort.Search(len(u.ring), func(i int) bool { return u.ring[i].hash >= h })
+		for n := 0; n < len(u.ring); n++ {
+			node := u.ring[(i+n)%len(u.ring)]
+			if ignoreEject || atomic.LoadInt64(&node.ep.ejectedUntil) <= now {
+				ep = node.ep
+				break
+			}
+		}
+	default:
+		ep = healthy[u.next%uint64(len(healthy))]
+		u.next++
+	}
+	return
+}
+
+func hashKey(key string) uint32 {
+	sum := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(sum[:4])
+}
+
+// 被动健康检查: 连续失败达到MaxFails后摘除一段时间
+func (u *upstream) report(ep *upstreamEndpoint, err error) {
+	if err == nil {
+		atomic.StoreInt32(&ep.fails, 0)
+		return
+	}
+	if err == ErrTCPCanceled || u.config.MaxFails <= 0 {
+		return
+	}
+	if atomic.AddInt32(&ep.fails, 1) >= int32(u.config.MaxFails) {
+		atomic.StoreInt32(&ep.fails, 0)
+		atomic.StoreInt64(&ep.ejectedUntil, time.Now().Add(u.config.EjectDuration).UnixNano())
+		log.WARNF("upstream[%s] eject endpoint %s for %v", u.name, ep.Addr, u.config.EjectDuration)
+	}
+}
+
+func sendUpstreamRequest(ctx context.Context, name string, key string, req []byte, needResponse bool) (res []byte, err error) {
+	u, err := getUpstream(name)
+	if err != nil {
+		return
+	}
+	ep, err := u.pick(key)
+	if err != nil {
+		return
+	}
+	if ep.tlsConfig != nil {
+		ctx = withClientTLS(ctx, u.tlsTag(), ep.tlsConfig)
+	}
+	atomic.AddInt64(&ep.inflight, 1)
+	res, err = sendClientRequestContext(ctx, ep.Addr, req, needResponse)
+	atomic.AddInt64(&ep.inflight, -1)
+	u.report(ep, err)
+	return
+}
+
+// ===================================================================================
+// 静态服务发现
+type StaticResolver map[string][]Endpoint
+
+func (r StaticResolver) Resolve(name string) ([]Endpoint, error) {
+	if endpoints, ok := r[name]; ok {
+		return endpoints, nil
+	}
+	return nil, ErrUpstreamNotFound
+}
+
+// 从json文件读取地址, 文件格式: {"name": [{"addr": "127.0.0.1:9000", "weight": 1}]}
+// 每次刷新都重新读取文件
+type FileResolver struct {
+	Path string
+}
+
+func (r *FileResolver) Resolve(name string) (endpoints []Endpoint, err error) {
+	data, err := ioutil.ReadFile(r.Path)
+	if err != nil {
+		return
+	}
+	all := make(map[string][]Endpoint)
+	if err = json.Unmarshal(data, &all); err != nil {
+		return
+	}
+	return StaticResolver(all).Resolve(name)
+}
+
+// DNS SRV服务发现, 查询_service._proto.name
+type SRVResolver struct {
+	Service string
+	Proto   string
+}
+
+func (r *SRVResolver) Resolve(name string) (endpoints []Endpoint, err error) {
+	_, srvs, err := net.LookupSRV(r.Service, r.Proto, name)
+	if err != nil {
+		return
+	}
+	for _, srv := range srvs {
+		endpoints = append(endpoints, Endpoint{
+			Addr:   net.JoinHostPort(srv.Target, strconv.Itoa(int(srv.Port))),
+			Weight: int(srv.Weight),
+		})
+	}
+	return
+}
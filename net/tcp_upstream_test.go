@@ -0,0 +1,52 @@
+package net
+
+import (
+	"context"
+	"crypto/tls"
+	"testing"
+)
+
+// 共用地址的两个upstream使用各自的TLS配置, 不写入按地址的配置
+func Test_UpstreamTLSIsolation(t *testing.T) {
+	addr := "127.0.0.1:19999"
+	a := &upstream{name: "tls_a", tlsConfig: &tls.Config{ServerName: "a"}, stop: make(chan bool)}
+	b := &upstream{name: "tls_b", tlsConfig: &tls.Config{}, stop: make(chan bool)}
+	a.setEndpoints([]Endpoint{{Addr: addr}})
+	b.setEndpoints([]Endpoint{{Addr: addr}})
+
+	if getClientTLS(addr) != nil {
+		t.Fatal("upstream TLS written to per-address config")
+	}
+	if name := a.endpoints[0].tlsConfig.ServerName; name != "a" {
+		t.Errorf("upstream a ServerName %q", name)
+	}
+	if name := b.endpoints[0].tlsConfig.ServerName; name != "127.0.0.1" {
+		t.Errorf("upstream b ServerName %q", name)
+	}
+
+	ctxA := withClientTLS(context.Background(), a.tlsTag(), a.endpoints[0].tlsConfig)
+	ctxB := withClientTLS(context.Background(), b.tlsTag(), b.endpoints[0].tlsConfig)
+	if clientTLSConfig(ctxA, addr) != a.endpoints[0].tlsConfig || clientTLSConfig(ctxB, addr) != b.endpoints[0].tlsConfig {
+		t.Error("ctx TLS config not used")
+	}
+	keyA, keyB := clientPoolKey(ctxA, addr), clientPoolKey(ctxB, addr)
+	if keyA == keyB || keyA == addr || keyB == addr {
+		t.Errorf("pool keys not isolated: %q %q", keyA, keyB)
+	}
+
+	// 摘除地址后关闭该upstream的空闲连接, 不影响其他upstream
+	ca, cb := newPipeClientConnection(), newPipeClientConnection()
+	clientPool.mu.Lock()
+	apA, apB := clientPool.addrPool(keyA, addr), clientPool.addrPool(keyB, addr)
+	apA.open, apA.idle = 1, []*clientTcpConnection{ca}
+	apB.open, apB.idle = 1, []*clientTcpConnection{cb}
+	clientPool.mu.Unlock()
+	a.setEndpoints(nil)
+	if !ca.tcpConn.IsClosed() || cb.tcpConn.IsClosed() {
+		t.Errorf("closed a:%v b:%v", ca.tcpConn.IsClosed(), cb.tcpConn.IsClosed())
+	}
+	b.close()
+	if !cb.tcpConn.IsClosed() {
+		t.Error("upstream close did not close idle connections")
+	}
+}
@@ -1,41 +1,121 @@
 package net
 
 import (
-	"encoding/binary"
 	"io"
+	"net"
 )
 
+// 拷贝模式下flush后保留的缓冲区上限, 超过时释放
+const maxWriterScratch = 64 * 1024
+
 type writer struct {
-	w   io.Writer
-	buf []byte
+	w     io.Writer
+	codec Codec
+
+	// 编码后等待发送的数据, flush时合并为一次writev或一次Write
+	bufs net.Buffers
+	// 编解码器未实现NoCopyCodec时, 写入的数据拷贝到scratch
+	noCopy  bool
+	scratch []byte
 }
 
-func newWriter(w io.Writer) *writer {
+func newWriter(w io.Writer, codec Codec) *writer {
+	if codec == nil {
+		codec = DefaultCodec
+	}
+	_, noCopy := codec.(NoCopyCodec)
 	return &writer{
-		w:   w,
-		buf: make([]byte, defaultHeadSize),
+		w:      w,
+		codec:  codec,
+		noCopy: noCopy,
 	}
 }
 
-func (w *writer) writePacket(packet []byte) (n int, err error) {
-	// 将数据包大小写入头部
-	n, err = w.writeHead(len(packet))
-	if err != nil {
-		return 0, err
+// 收集编码器写入的数据; NoCopyCodec不拷贝, 其他编解码器拷贝后保存, 不保留p
+func (w *writer) Write(p []byte) (int, error) {
+	if w.noCopy {
+		w.bufs = append(w.bufs, p)
+		return len(p), nil
+	}
+	// scratch扩容后之前的切片仍指向旧的内存, 内容不变
+	start := len(w.scratch)
+	w.scratch = append(w.scratch, p...)
+	w.bufs = append(w.bufs, w.scratch[start:len(w.scratch):len(w.scratch)])
+	return len(p), nil
+}
+
+func (w *writer) writeControl(frame ControlFrame) (err error) {
+	if err = w.encodeControl(frame); err != nil {
+		return
+	}
+	return w.flush()
+}
+
+func (w *writer) encodeControl(frame ControlFrame) (err error) {
+	codec, ok := w.codec.(ControlCodec)
+	if !ok {
+		return ErrHeartbeatCodec
 	}
-	// 发送数据包
-	return w.writeBody(packet)
+	mark, scratchMark := len(w.bufs), len(w.scratch)
+	if err = codec.WriteControl(w, frame); err != nil {
+		w.bufs, w.scratch = w.bufs[:mark], w.scratch[:scratchMark]
+	}
+	return
 }
 
-func (w *writer) writeHead(plen int) (n int, err error) {
-	return w.writeUint32BE(uint32(plen))
+func (w *writer) writePacket(packet []byte) (n int, err error) {
+	// 按编解码器加上头部后发送数据包, 头部和数据合并发送
+	if n, err = w.encode(packet); err != nil {
+		return
+	}
+	err = w.flush()
+	return
 }
 
-func (w *writer) writeUint32BE(v uint32) (n int, err error) {
-	binary.BigEndian.PutUint32(w.buf[:defaultHeadSize], v)
-	return w.w.Write(w.buf[:defaultHeadSize])
+// 编码数据包, 出错时丢弃该数据包已写入的部分
+func (w *writer) encode(packet []byte) (n int, err error) {
+	mark, scratchMark := len(w.bufs), len(w.scratch)
+	if n, err = w.codec.WriteFrame(w, packet); err != nil {
+		w.bufs, w.scratch = w.bufs[:mark], w.scratch[:scratchMark]
+	}
+	return
 }
 
-func (w *writer) writeBody(body []byte) (n int, err error) {
-	return w.w.Write(body)
+func (w *writer) flush() (err error) {
+	bufs := w.bufs
+	defer func() {
+		for i := range w.bufs {
+			w.bufs[i] = nil
+		}
+		w.bufs = w.bufs[:0]
+		if cap(w.scratch) > maxWriterScratch {
+			w.scratch = nil
+		} else {
+			w.scratch = w.scratch[:0]
+		}
+	}()
+	switch len(bufs) {
+	case 0:
+		return
+	case 1:
+		_, err = w.w.Write(bufs[0])
+		return
+	}
+	switch w.w.(type) {
+	case *net.TCPConn, *net.UnixConn:
+		// 使用writev一次发送
+		_, err = bufs.WriteTo(w.w)
+	default:
+		// TLS等连接合并到一个buffer后发送, 避免多次加密和多个记录
+		size := 0
+		for _, b := range bufs {
+			size += len(b)
+		}
+		buf := make([]byte, 0, size)
+		for _, b := range bufs {
+			buf = append(buf, b...)
+		}
+		_, err = w.w.Write(buf)
+	}
+	return
 }
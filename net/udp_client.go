@@ -0,0 +1,262 @@
+package net
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xuhn/optimusprime/log"
+)
+
+// 请求/回包数据报前4字节为大端请求id, 服务端回包时原样带回
+const udpIdSize = 4
+
+var (
+	ErrUDPTimeout  = errors.New("udp request timeout")
+	ErrUDPCanceled = errors.New("udp request canceled")
+	ErrUDPFrame    = errors.New("udp datagram too short")
+	ErrUDPClosed   = errors.New("udp client closed")
+)
+
+const (
+	// 空闲超过该时间的socket被关闭, 下次请求时重新创建
+	udpClientIdleTimeout  = 5 * time.Minute
+	udpClientReapInterval = time.Minute
+	// 连续读错误时的退避时间
+	udpReadMinBackoff = 5 * time.Millisecond
+	udpReadMaxBackoff = time.Second
+	// 数据报可能丢失, 未设置超时的请求使用默认超时, 避免一直等待
+	defaultUDPRequestTimeout = 3 * time.Second
+)
+
+// 每个对端地址一个UDP socket, 多个请求共享, 按请求id分发回包
+type udpClientConn struct {
+	remote_addr string
+	conn        *net.UDPConn
+	nextId      uint32
+
+	pendingMu sync.Mutex
+	pending   map[uint32]chan []byte
+
+	// 正在使用的请求数和最后使用时间, 用于回收空闲socket
+	active   int32
+	lastUsed int64
+
+	closeOnce sync.Once
+	closed    chan struct{}
+}
+
+var (
+	udpClientsMu sync.Mutex
+	udpClients   = make(map[string]*udpClientConn)
+	udpReapOnce  sync.Once
+)
+
+// 获取对端地址的socket, 使用完后需调用done
+func getUDPClient(remote_addr string) (c *udpClientConn, err error) {
+	udpReapOnce.Do(func() {
+		go reapUDPClients()
+	})
+	udpClientsMu.Lock()
+	defer udpClientsMu.Unlock()
+	if c, ok := udpClients[remote_addr]; ok && !c.isClosed() {
+		c.use()
+		return c, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", remote_addr)
+	if err != nil {
+		return
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return
+	}
+	c = &udpClientConn{
+		remote_addr: remote_addr,
+		conn:        conn,
+		pending:     make(map[uint32]chan []byte),
+		closed:      make(chan struct{}),
+	}
+	c.use()
+	udpClients[remote_addr] = c
+	go c.readLoop()
+	return
+}
+
+// 调用方需持有udpClientsMu
+func (c *udpClientConn) use() {
+	atomic.AddInt32(&c.active, 1)
+	atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+}
+
+func (c *udpClientConn) done() {
+	atomic.StoreInt64(&c.lastUsed, time.Now().UnixNano())
+	atomic.AddInt32(&c.active, -1)
+}
+
+func (c *udpClientConn) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+// 关闭socket, 等待中的请求返回ErrUDPClosed
+func (c *udpClientConn) close() {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+		c.conn.Close()
+	})
+}
+
+// 关闭并移除对端地址的socket, 下次请求时重新创建
+func closeUDPClient(remote_addr string) {
+	udpClientsMu.Lock()
+	c, ok := udpClients[remote_addr]
+	delete(udpClients, remote_addr)
+	udpClientsMu.Unlock()
+	if ok {
+		c.close()
+	}
+}
+
+func reapUDPClients() {
+	for {
+		time.Sleep(udpClientReapInterval)
+		reapIdleUDPClients(time.Now().Add(-udpClientIdleTimeout))
+	}
+}
+
+// 关闭没有正在进行的请求且在before之后未使用的socket
+func reapIdleUDPClients(before time.Time) {
+	var closing []*udpClientConn
+	udpClientsMu.Lock()
+	for addr, c := range udpClients {
+		if c.isClosed() || atomic.LoadInt32(&c.active) == 0 && atomic.LoadInt64(&c.lastUsed) < before.UnixNano() {
+			delete(udpClients, addr)
+			closing = append(closing, c)
+		}
+	}
+	udpClientsMu.Unlock()
+	for _, c := range closing {
+		log.DEBUGF("close idle udp client [ %s -> %s ]", c.conn.LocalAddr(), c.remote_addr)
+		c.close()
+	}
+}
+
+func (c *udpClientConn) readLoop() {
+	buf := make([]byte, defaultMaxDatagramSize)
+	backoff := time.Duration(0)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			// 关闭socket前总是先设置closed, 读错误只需检查closed
+			if c.isClosed() {
+				c.close()
+				return
+			}
+			// 对端端口不可达时会收到ICMP错误, 不影响后续请求; 连续出错时退避, 避免空转
+			log.DEBUGF("udp client [ %s -> %s ] read fail:%v", c.conn.LocalAddr(), c.conn.RemoteAddr(), err)
+			if backoff == 0 {
+				backoff = udpReadMinBackoff
+			} else if backoff *= 2; backoff > udpReadMaxBackoff {
+				backoff = udpReadMaxBackoff
+			}
+			select {
+			case <-time.After(backoff):
+			case <-c.closed:
+				return
+			}
+			continue
+		}
+		backoff = 0
+		if n < udpIdSize {
+			log.DEBUGF("drop udp datagram from %s: %v", c.conn.RemoteAddr(), ErrUDPFrame)
+			continue
+		}
+		id := binary.BigEndian.Uint32(buf[:udpIdSize])
+		c.pendingMu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.pendingMu.Unlock()
+		if !ok {
+			// 已超时或重复的回包
+			log.DEBUGF("drop udp response id(%d) from %s", id, c.conn.RemoteAddr())
+			continue
+		}
+		res := make([]byte, n-udpIdSize)
+		copy(res, buf[udpIdSize:n])
+		ch <- res
+	}
+}
+
+func (c *udpClientConn) request(ctx context.Context, req []byte, needResponse bool) (res []byte, err error) {
+	id := atomic.AddUint32(&c.nextId, 1)
+	ch := make(chan []byte, 1)
+	if needResponse {
+		c.pendingMu.Lock()
+		c.pending[id] = ch
+		c.pendingMu.Unlock()
+		defer func() {
+			c.pendingMu.Lock()
+			delete(c.pending, id)
+			c.pendingMu.Unlock()
+		}()
+	}
+
+	datagram := make([]byte, udpIdSize+len(req))
+	binary.BigEndian.PutUint32(datagram, id)
+	copy(datagram[udpIdSize:], req)
+	if _, err = c.conn.Write(datagram); err != nil || !needResponse {
+		return
+	}
+
+	select {
+	case res = <-ch:
+		return
+	case <-c.closed:
+		return nil, ErrUDPClosed
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrUDPTimeout
+		}
+		return nil, ErrUDPCanceled
+	}
+}
+
+func sendUDPRequestContext(ctx context.Context, remote_addr string, req []byte, needResponse bool) (res []byte, err error) {
+	if _, ok := ctx.Deadline(); needResponse && !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, defaultUDPRequestTimeout)
+		defer cancel()
+	}
+	c, err := getUDPClient(remote_addr)
+	if err != nil {
+		return
+	}
+	defer c.done()
+	return c.request(ctx, req, needResponse)
+}
+
+// 解析带请求id的数据报
+func parseUDPRequest(msg []byte) (id uint32, req []byte, err error) {
+	if len(msg) < udpIdSize {
+		return 0, nil, ErrUDPFrame
+	}
+	return binary.BigEndian.Uint32(msg[:udpIdSize]), msg[udpIdSize:], nil
+}
+
+// 回包带回请求id
+func sendUDPResponse(session *UDPSession, id uint32, res []byte) (err error) {
+	datagram := make([]byte, udpIdSize+len(res))
+	binary.BigEndian.PutUint32(datagram, id)
+	copy(datagram[udpIdSize:], res)
+	_, err = session.Send(datagram)
+	return
+}
@@ -0,0 +1,59 @@
+package net
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func Test_UDPClientClose(t *testing.T) {
+	// 不回包的对端
+	peer, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+	addr := peer.LocalAddr().String()
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := sendUDPRequestContext(context.Background(), addr, []byte("ping"), true)
+		errCh <- err
+	}()
+	buf := make([]byte, 64)
+	peer.SetReadDeadline(time.Now().Add(time.Second))
+	if _, _, err = peer.ReadFrom(buf); err != nil {
+		t.Fatal(err)
+	}
+	udpClientsMu.Lock()
+	old := udpClients[addr]
+	udpClientsMu.Unlock()
+	closeUDPClient(addr)
+	select {
+	case err = <-errCh:
+		if err != ErrUDPClosed {
+			t.Errorf("pending request returned %v, want ErrUDPClosed", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("pending request not failed after close")
+	}
+
+	// 空闲的socket被回收, 正在使用的保留
+	c, err := getUDPClient(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c == old {
+		t.Error("closed client reused")
+	}
+	reapIdleUDPClients(time.Now().Add(time.Hour))
+	if !func() bool { udpClientsMu.Lock(); defer udpClientsMu.Unlock(); return udpClients[addr] == c }() {
+		t.Error("active client reaped")
+	}
+	c.done()
+	reapIdleUDPClients(time.Now().Add(time.Hour))
+	if !c.isClosed() {
+		t.Error("idle client not reaped")
+	}
+}
@@ -0,0 +1,310 @@
+package net
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xuhn/optimusprime/log"
+	"github.com/xuhn/optimusprime/net/ratelimiter"
+)
+
+const (
+	defaultUDPSessionTimeout = 60 * time.Second
+	defaultMaxDatagramSize   = 64 * 1024
+	defaultUDPMaxSessions    = 10000
+	defaultUDPMaxConcurrent  = 1024
+)
+
+var (
+	ErrUDPServerClosed = errors.New("udp server closed")
+)
+
+var (
+	// 收到数据报时调用, 每个数据报启动一个goroutine处理, 同时处理的数量受MaxConcurrent限制
+	OnDatagram = func(session *UDPSession, msg []byte) {}
+	// 会话超时或服务关闭时调用
+	OnUDPSessionClose = func(session *UDPSession) {}
+)
+
+// UDP服务配置
+type UDPServerConfig struct {
+	// 会话超时, 超过该时间未收到对端数据则删除会话, 0使用默认值60s
+	SessionTimeout time.Duration
+	// 最大数据报长度, 0使用默认值64K
+	MaxDatagramSize int
+	// 单个来源地址每秒允许的数据报数, 0不限制; 超出的数据报被丢弃
+	Rate float32
+	// 单个来源地址的突发容量, 0时与Rate相同
+	Burst int64
+	// 最大会话数, 0使用默认值10000, 小于0不限制; 超出时丢弃新对端的数据报
+	MaxSessions int
+	// 同时处理的数据报数, 0使用默认值1024, 小于0不限制; 达到上限时暂停读取
+	MaxConcurrent int
+}
+
+// UDP会话, 按对端地址区分
+type UDPSession struct {
+	id         uint64
+	server     *udpServer
+	addr       *net.UDPAddr
+	key        string
+	lastActive int64
+	ratelimit  *ratelimiter.RateLimit
+
+	mu     sync.RWMutex
+	values map[string]interface{}
+}
+
+type udpServer struct {
+	conn   *net.UDPConn
+	config UDPServerConfig
+
+	sessions     map[string]*UDPSession
+	sessionMutex sync.Mutex
+	maxSessionId uint64
+
+	// 因限速或会话数超限被丢弃的数据报数
+	dropped uint64
+	// 限制同时处理的数据报数, 为空不限制
+	sem chan struct{}
+
+	stopFlag int32
+	stop     chan bool
+}
+
+// UDPServer 对外暴露的UDP服务句柄
+type UDPServer struct {
+	s *udpServer
+}
+
+func listenUDP(listen_addr string, listen_port int) (conn *net.UDPConn, err error) {
+	listen_ip, err := parseListenAddr(listen_addr)
+	if err != nil {
+		return
+	}
+	addr, err := net.ResolveUDPAddr("udp", net.JoinHostPort(listen_ip, strconv.Itoa(listen_port)))
+	if err != nil {
+		return
+	}
+	return net.ListenUDP("udp", addr)
+}
+
+func newUdpServer(conn *net.UDPConn, config *UDPServerConfig) *udpServer {
+	s := &udpServer{
+		conn:     conn,
+		sessions: make(map[string]*UDPSession),
+		stop:     make(chan bool),
+	}
+	if config != nil {
+		s.config = *config
+	}
+	if s.config.SessionTimeout <= 0 {
+		s.config.SessionTimeout = defaultUDPSessionTimeout
+	}
+	if s.config.MaxDatagramSize <= 0 {
+		s.config.MaxDatagramSize = defaultMaxDatagramSize
+	}
+	if s.config.MaxSessions == 0 {
+		s.config.MaxSessions = defaultUDPMaxSessions
+	}
+	if s.config.MaxConcurrent == 0 {
+		s.config.MaxConcurrent = defaultUDPMaxConcurrent
+	}
+	if s.config.MaxConcurrent > 0 {
+		s.sem = make(chan struct{}, s.config.MaxConcurrent)
+	}
+	if s.config.Rate > 0 && s.config.Burst <= 0 {
+		s.config.Burst = int64(s.config.Rate)
+		if s.config.Burst < 1 {
+			s.config.Burst = 1
+		}
+	}
+	return s
+}
+
+func (s *udpServer) serve() (err error) {
+	log.DEBUGF("udp server start service at %s", s.conn.LocalAddr())
+	go s.expireSessions()
+	buf := make([]byte, s.config.MaxDatagramSize)
+	for {
+		n, addr, err := s.conn.ReadFromUDP(buf)
+		if err != nil {
+			if s.isStopping() {
+				return ErrUDPServerClosed
+			}
+			// 对端不可达等错误不影响其他对端, 继续读取
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				continue
+			}
+			log.ERRORF("udp read fail:%v", err)
+			return err
+		}
+		session := s.getSession(addr)
+		if session == nil {
+			atomic.AddUint64(&s.dropped, 1)
+			continue
+		}
+		atomic.StoreInt64(&session.lastActive, time.Now().UnixNano())
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		if s.sem != nil {
+			select {
+			case s.sem <- struct{}{}:
+			case <-s.stop:
+				return ErrUDPServerClosed
+			}
+		}
+		// 钩子函数，用于业务server嵌入接收数据报时的逻辑
+		go s.handleDatagram(session, msg)
+	}
+}
+
+func (s *udpServer) handleDatagram(session *UDPSession, msg []byte) {
+	if s.sem != nil {
+		defer func() { <-s.sem }()
+	}
+	OnDatagram(session, msg)
+}
+
+// 获取对端的会话, 超出限速或会话数上限时返回nil; 新对端先检查限速和会话数再创建会话
+func (s *udpServer) getSession(addr *net.UDPAddr) *UDPSession {
+	key := addr.String()
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	if session, ok := s.sessions[key]; ok {
+		if session.ratelimit != nil && !session.ratelimit.Allow(1) {
+			return nil
+		}
+		return session
+	}
+	var ratelimit *ratelimiter.RateLimit
+	if s.config.Rate > 0 {
+		ratelimit = ratelimiter.NewRateLimit("token", s.config.Rate, s.config.Burst)
+		if !ratelimit.Allow(1) {
+			return nil
+		}
+	}
+	if s.config.MaxSessions > 0 && len(s.sessions) >= s.config.MaxSessions {
+		return nil
+	}
+	s.maxSessionId++
+	session := &UDPSession{
+		id:        s.maxSessionId,
+		server:    s,
+		addr:      addr,
+		key:       key,
+		ratelimit: ratelimit,
+	}
+	s.sessions[key] = session
+	return session
+}
+
+// 定时删除超时的会话
+func (s *udpServer) expireSessions() {
+	interval := s.config.SessionTimeout / 2
+	if interval < time.Second {
+		interval = time.Second
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-s.stop:
+			return
+		}
+		deadline := time.Now().Add(-s.config.SessionTimeout).UnixNano()
+		var expired []*UDPSession
+		s.sessionMutex.Lock()
+		for key, session := range s.sessions {
+			if atomic.LoadInt64(&session.lastActive) < deadline {
+				delete(s.sessions, key)
+				expired = append(expired, session)
+			}
+		}
+		s.sessionMutex.Unlock()
+		for _, session := range expired {
+			log.DEBUGF("udp session [ %s ] expired", session.key)
+			OnUDPSessionClose(session)
+		}
+	}
+}
+
+func (s *udpServer) isStopping() bool {
+	return atomic.LoadInt32(&s.stopFlag) != 0
+}
+
+func (s *udpServer) close() error {
+	if !atomic.CompareAndSwapInt32(&s.stopFlag, 0, 1) {
+		return ErrUDPServerClosed
+	}
+	close(s.stop)
+	err := s.conn.Close()
+	s.sessionMutex.Lock()
+	sessions := s.sessions
+	s.sessions = make(map[string]*UDPSession)
+	s.sessionMutex.Unlock()
+	for _, session := range sessions {
+		OnUDPSessionClose(session)
+	}
+	return err
+}
+
+func (s *udpServer) lenSessions() int {
+	s.sessionMutex.Lock()
+	defer s.sessionMutex.Unlock()
+	return len(s.sessions)
+}
+
+// ===================================================================================
+func (session *UDPSession) Id() uint64           { return session.id }
+func (session *UDPSession) RemoteAddr() net.Addr { return session.addr }
+func (session *UDPSession) LocalAddr() net.Addr  { return session.server.conn.LocalAddr() }
+func (session *UDPSession) LastActive() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&session.lastActive))
+}
+
+// 向对端发送数据报
+func (session *UDPSession) Send(msg []byte) (n int, err error) {
+	return session.server.conn.WriteToUDP(msg, session.addr)
+}
+
+func (session *UDPSession) SetValue(key string, value interface{}) {
+	session.mu.Lock()
+	defer session.mu.Unlock()
+	if session.values == nil {
+		session.values = make(map[string]interface{})
+	}
+	session.values[key] = value
+}
+
+func (session *UDPSession) Value(key string) (value interface{}, ok bool) {
+	session.mu.RLock()
+	defer session.mu.RUnlock()
+	value, ok = session.values[key]
+	return
+}
+
+// ===================================================================================
+// 监听地址
+func (s *UDPServer) Addr() net.Addr {
+	return s.s.conn.LocalAddr()
+}
+
+// 当前会话数
+func (s *UDPServer) LenSessions() int {
+	return s.s.lenSessions()
+}
+
+// 因限速或会话数超限被丢弃的数据报数
+func (s *UDPServer) Dropped() uint64 {
+	return atomic.LoadUint64(&s.s.dropped)
+}
+
+func (s *UDPServer) Close() error {
+	return s.s.close()
+}
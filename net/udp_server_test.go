@@ -0,0 +1,68 @@
+package net
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func startTestUDPServer(t *testing.T, config *UDPServerConfig) *udpServer {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newUdpServer(conn, config)
+	go s.serve()
+	return s
+}
+
+func sendTestDatagram(t *testing.T, s *udpServer, msg string) *net.UDPConn {
+	conn, err := net.DialUDP("udp", nil, s.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = conn.Write([]byte(msg)); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(time.Second); !cond(); time.Sleep(5 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timeout waiting for %s", what)
+		}
+	}
+}
+
+// 超出会话数上限时不创建会话, 同时处理的数据报数不超过MaxConcurrent
+func Test_UDPServerLimits(t *testing.T) {
+	release := make(chan struct{})
+	var handled int32
+	OnDatagram = func(session *UDPSession, msg []byte) {
+		atomic.AddInt32(&handled, 1)
+		<-release
+	}
+	defer func() { OnDatagram = func(session *UDPSession, msg []byte) {} }()
+	s := startTestUDPServer(t, &UDPServerConfig{MaxSessions: 1, MaxConcurrent: 1})
+	defer s.close()
+
+	first := sendTestDatagram(t, s, "a")
+	defer first.Close()
+	waitUntil(t, "first datagram", func() bool { return atomic.LoadInt32(&handled) == 1 })
+	second := sendTestDatagram(t, s, "b")
+	defer second.Close()
+	waitUntil(t, "second peer dropped", func() bool { return atomic.LoadUint64(&s.dropped) == 1 })
+	if n := s.lenSessions(); n != 1 {
+		t.Errorf("sessions %d, want 1", n)
+	}
+
+	first.Write([]byte("c"))
+	time.Sleep(50 * time.Millisecond)
+	if n := atomic.LoadInt32(&handled); n != 1 {
+		t.Fatalf("handled %d datagrams beyond MaxConcurrent", n)
+	}
+	close(release)
+	waitUntil(t, "queued datagram", func() bool { return atomic.LoadInt32(&handled) == 2 })
+}
@@ -161,6 +161,44 @@ type Conn struct {
 	frameHandler
 	PayloadType        byte
 	defaultCloseStatus int
+
+	doneMu sync.Mutex
+	done   chan struct{}
+}
+
+// Done returns a channel that is closed when the connection is closed
+// or when Read/Write fails with a non-timeout error, i.e. the peer is gone.
+func (ws *Conn) Done() <-chan struct{} {
+	ws.doneMu.Lock()
+	defer ws.doneMu.Unlock()
+	if ws.done == nil {
+		ws.done = make(chan struct{})
+	}
+	return ws.done
+}
+
+func (ws *Conn) markDone() {
+	ws.doneMu.Lock()
+	defer ws.doneMu.Unlock()
+	if ws.done == nil {
+		ws.done = make(chan struct{})
+	}
+	select {
+	case <-ws.done:
+	default:
+		close(ws.done)
+	}
+}
+
+// markDoneOnError closes Done unless err is nil or a timeout.
+func (ws *Conn) markDoneOnError(err error) {
+	if err == nil {
+		return
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return
+	}
+	ws.markDone()
 }
 
 // Read implements the io.Reader interface:
@@ -171,6 +209,7 @@ type Conn struct {
 func (ws *Conn) Read(msg []byte) (n int, err error) {
 	ws.rio.Lock()
 	defer ws.rio.Unlock()
+	defer func() { ws.markDoneOnError(err) }()
 again:
 	if ws.frameReader == nil {
 		frame, err := ws.frameReaderFactory.NewFrameReader()
@@ -201,6 +240,7 @@ again:
 func (ws *Conn) Write(msg []byte) (n int, err error) {
 	ws.wio.Lock()
 	defer ws.wio.Unlock()
+	defer func() { ws.markDoneOnError(err) }()
 	w, err := ws.frameWriterFactory.NewFrameWriter(ws.PayloadType)
 	if err != nil {
 		return 0, err
@@ -215,6 +255,7 @@ func (ws *Conn) Write(msg []byte) (n int, err error) {
 
 // Close implements the io.Closer interface.
 func (ws *Conn) Close() error {
+	defer ws.markDone()
 	err := ws.frameHandler.WriteClose(ws.defaultCloseStatus)
 	err1 := ws.rwc.Close()
 	if err != nil {
@@ -293,10 +334,12 @@ func (cd Codec) Send(ws *Conn, v interface{}) (err error) {
 	defer ws.wio.Unlock()
 	w, err := ws.frameWriterFactory.NewFrameWriter(payloadType)
 	if err != nil {
+		ws.markDoneOnError(err)
 		return err
 	}
 	_, err = w.Write(data)
 	w.Close()
+	ws.markDoneOnError(err)
 	return err
 }
 
@@ -307,6 +350,7 @@ func (cd Codec) Receive(ws *Conn, v interface{}) (err error) {
 	if ws.frameReader != nil {
 		_, err = io.Copy(ioutil.Discard, ws.frameReader)
 		if err != nil {
+			ws.markDoneOnError(err)
 			return err
 		}
 		ws.frameReader = nil
@@ -314,10 +358,12 @@ func (cd Codec) Receive(ws *Conn, v interface{}) (err error) {
 again:
 	frame, err := ws.frameReaderFactory.NewFrameReader()
 	if err != nil {
+		ws.markDoneOnError(err)
 		return err
 	}
 	frame, err = ws.frameHandler.HandleFrame(frame)
 	if err != nil {
+		ws.markDoneOnError(err)
 		return err
 	}
 	if frame == nil {
@@ -326,6 +372,7 @@ again:
 	payloadType := frame.PayloadType()
 	data, err := ioutil.ReadAll(frame)
 	if err != nil {
+		ws.markDoneOnError(err)
 		return err
 	}
 	return cd.Unmarshal(data, payloadType, v)
@@ -0,0 +1,69 @@
+package mysql
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultLockTable = "timer_lock"
+
+// 基于租约表的分布式锁, 实现task.Locker
+// 过期时间使用数据库时间, 避免各实例时钟不一致
+type LeaseLocker struct {
+	conn  *MysqlConn
+	table string
+}
+
+// table为空时使用timer_lock, 表结构见CreateTable
+func NewLeaseLocker(conn *MysqlConn, table string) *LeaseLocker {
+	if table == "" {
+		table = defaultLockTable
+	}
+	return &LeaseLocker{conn: conn, table: table}
+}
+
+// 创建租约表
+func (l *LeaseLocker) CreateTable() (err error) {
+	_, err = l.conn.db.Exec(fmt.Sprintf("CREATE TABLE IF NOT EXISTS `%s` ("+
+		"`name` VARCHAR(128) NOT NULL,"+
+		"`owner` VARCHAR(64) NOT NULL,"+
+		"`expire_at` DATETIME(3) NOT NULL,"+
+		"PRIMARY KEY (`name`)"+
+		") ENGINE=InnoDB DEFAULT CHARSET=utf8mb4", l.table))
+	return
+}
+
+// 获取锁, 租约不存在、已过期或已属于owner时成功
+// ON DUPLICATE KEY UPDATE按顺序赋值, 更新expire_at时owner已是新值
+func (l *LeaseLocker) Lock(key string, owner string, ttl time.Duration) (ok bool, err error) {
+	_, err = l.conn.Update(fmt.Sprintf("INSERT INTO `%s` (`name`, `owner`, `expire_at`) "+
+		"VALUES (?, ?, DATE_ADD(NOW(3), INTERVAL ? MICROSECOND)) "+
+		"ON DUPLICATE KEY UPDATE "+
+		"`owner` = IF(`expire_at` < NOW(3), VALUES(`owner`), `owner`), "+
+		"`expire_at` = IF(`owner` = VALUES(`owner`), VALUES(`expire_at`), `expire_at`)", l.table),
+		key, owner, ttl.Microseconds())
+	if err != nil {
+		return
+	}
+	results, err := l.conn.Select(fmt.Sprintf("SELECT `owner` FROM `%s` WHERE `name` = ?", l.table), key)
+	if err != nil || len(results) == 0 {
+		return
+	}
+	return results[0]["owner"] == owner, nil
+}
+
+// 续约, 租约已被其他owner获取时返回false
+func (l *LeaseLocker) Renew(key string, owner string, ttl time.Duration) (ok bool, err error) {
+	rowsAffected, err := l.conn.Update(fmt.Sprintf("UPDATE `%s` SET `expire_at` = DATE_ADD(NOW(3), INTERVAL ? MICROSECOND) "+
+		"WHERE `name` = ? AND `owner` = ?", l.table), ttl.Microseconds(), key, owner)
+	if err != nil {
+		return
+	}
+	return rowsAffected > 0, nil
+}
+
+// 释放锁
+func (l *LeaseLocker) Unlock(key string, owner string) (err error) {
+	_, err = l.conn.Delete(fmt.Sprintf("DELETE FROM `%s` WHERE `name` = ? AND `owner` = ?", l.table), key, owner)
+	return
+}
@@ -1,8 +1,8 @@
 package task
 
 import (
+	"context"
 	"encoding/json"
-	"errors"
 	"io/ioutil"
 	"net/http"
 	"strconv"
@@ -10,7 +10,6 @@ import (
 	"sync/atomic"
 	"time"
 
-	"github.com/xuhn/optimusprime/common"
 	"github.com/xuhn/optimusprime/log"
 )
 
@@ -21,13 +20,13 @@ var (
 
 type APITask struct {
 	Id         int32
-	Gid        uint64
 	Pattern    string
 	Handler    ApiTaskHandler
 	FuncName   string
 	State      taskState
 	timeOut    time.Duration
 	isFinished chan bool
+	runState   int32
 }
 
 func NewAPITask(pattern string) (task *APITask, err error) {
@@ -41,7 +40,7 @@ func NewAPITask(pattern string) (task *APITask, err error) {
 		Handler:    taskHandle.handler,
 		State:      stateNew,
 		timeOut:    taskHandle.timeOut,
-		isFinished: make(chan bool),
+		isFinished: make(chan bool, 1),
 	}
 	apiTaskPoolMu.Lock()
 	apiTaskPool[task.Id] = task
@@ -49,35 +48,36 @@ func NewAPITask(pattern string) (task *APITask, err error) {
 	return
 }
 
+// 超时或客户端断开时Run立即返回, handler的结果只在Run返回前写入rw
 func (t *APITask) Run(rw http.ResponseWriter, r *http.Request) (res []byte, err error) {
 	t.setState(stateRun)
+	t.FuncName = GetTaskFuncName(t.Handler)
+	ctx, cancel := taskContext(r.Context(), t.timeOut)
+	defer cancel()
+	ctx = withTaskInfo(ctx, &TaskInfo{Type: TaskTypeAPI, Id: t.Id, FuncName: t.FuncName})
 
-	funcName := GetTaskFuncName(t.Handler)
+	var data []byte
+	var execErr error
 	go func() {
-		t.Gid = common.GetGID()
-		t.FuncName = funcName
-		err := execute(rw, r, t.Handler)
-		if err != nil {
-			log.DEBUGF("[API_TASK(%d)|%s] execute err: %s", t.Id, funcName, err.Error())
+		defer finishTask(&t.runState)
+		data, execErr = execute(ctx, r, t.Handler)
+		if execErr != nil {
+			log.DEBUGF("[API_TASK(%d)|%s] execute err: %s", t.Id, t.FuncName, execErr.Error())
 		}
 		t.isFinished <- true
 	}()
 
-	if t.timeOut > 0 {
-		select {
-		case <-t.isFinished:
-			t.setState(stateFinished)
-		case <-time.After(t.timeOut):
-			t.setState(stateFinished)
-			err = errors.New("task timet out")
-
-		}
-	} else {
-		select {
-		case <-t.isFinished:
-			t.setState(stateFinished)
+	select {
+	case <-t.isFinished:
+		rw.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if execErr == nil {
+			rw.Write(data)
 		}
+	case <-ctx.Done():
+		abandonTask(&t.runState)
+		err = taskContextError(ctx)
 	}
+	t.setState(stateFinished)
 
 	apiTaskPoolMu.Lock()
 	delete(apiTaskPool, t.Id)
@@ -89,9 +89,7 @@ func (t *APITask) setState(state taskState) {
 	t.State = state
 }
 
-func execute(rw http.ResponseWriter, r *http.Request, h ApiTaskHandler) (err error) {
-	rw.Header().Set("Content-Type", "application/json; charset=utf-8")
-
+func execute(ctx context.Context, r *http.Request, h ApiTaskHandler) (data []byte, err error) {
 	p := make(map[string]string)
 	b := make([]byte, 0)
 
@@ -113,15 +111,7 @@ func execute(rw http.ResponseWriter, r *http.Request, h ApiTaskHandler) (err err
 		}
 	}
 
-	data, err := json.Marshal(h.ServeRequest(p))
-
-	if err != nil {
-		return
-	}
-
-	rw.Write(data)
-
-	return
+	return json.Marshal(h.ServeRequest(ctx, p))
 }
 
 func parseJsonParams(b []byte) (ret map[string]string, err error) {
@@ -149,17 +139,6 @@ func LenAPITasks() int {
 	return len(apiTaskPool)
 }
 
-func GetAPITaskByGid(gid uint64) (task interface{}) {
-	apiTaskPoolMu.Lock()
-	defer apiTaskPoolMu.Unlock()
-	for _, t := range apiTaskPool {
-		if t.Gid == gid {
-			return t
-		}
-	}
-	return nil
-}
-
 func DumpAPITasks() (tasks map[int32]*APITask) {
 	tasks = make(map[int32]*APITask)
 	apiTaskPoolMu.Lock()
@@ -1,20 +1,22 @@
 package task
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 )
 
+// ctx在超时或客户端断开时取消
 type ApiTaskHandler interface {
-	ServeRequest(params map[string]string) (result interface{})
+	ServeRequest(ctx context.Context, params map[string]string) (result interface{})
 }
 
-type APITaskFunc func(params map[string]string) (result interface{})
+type APITaskFunc func(ctx context.Context, params map[string]string) (result interface{})
 
-func (t APITaskFunc) ServeRequest(params map[string]string) (result interface{}) {
-	return t(params)
+func (t APITaskFunc) ServeRequest(ctx context.Context, params map[string]string) (result interface{}) {
+	return t(ctx, params)
 }
 
 type apiTaskHandle struct {
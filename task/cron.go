@@ -0,0 +1,283 @@
+package task
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 定时任务的调度规则
+type Schedule interface {
+	// t之后的下一次执行时间, 没有下一次时返回零值
+	Next(t time.Time) time.Time
+}
+
+// 固定间隔
+type intervalSchedule struct {
+	interval time.Duration
+}
+
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(s.interval)
+}
+
+// 按间隔执行的调度规则
+func Every(interval time.Duration) Schedule {
+	if interval <= 0 {
+		interval = time.Second
+	}
+	return intervalSchedule{interval: interval}
+}
+
+// cron表达式, 每个字段为允许取值的位集合
+type cronSchedule struct {
+	second, minute, hour, dom, month, dow uint64
+	// dom和dow都不为*时满足其一即可, 否则需同时满足
+	domStar, dowStar bool
+	location         *time.Location
+}
+
+type cronField struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	secondField = cronField{0, 59, nil}
+	minuteField = cronField{0, 59, nil}
+	hourField   = cronField{0, 23, nil}
+	domField    = cronField{1, 31, nil}
+	monthField  = cronField{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	// 0和7都表示周日
+	dowField = cronField{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+)
+
+var cronDescriptors = map[string]string{
+	"@yearly":   "0 0 0 1 1 *",
+	"@annually": "0 0 0 1 1 *",
+	"@monthly":  "0 0 0 1 * *",
+	"@weekly":   "0 0 0 * * 0",
+	"@daily":    "0 0 0 * * *",
+	"@midnight": "0 0 0 * * *",
+	"@hourly":   "0 0 * * * *",
+}
+
+var ErrCronSpec = errors.New("invalid cron spec")
+
+// 解析cron表达式, 支持:
+//
+//	5个字段: 分 时 日 月 周
+//	6个字段: 秒 分 时 日 月 周
+//	@yearly @monthly @weekly @daily @hourly, @every 1h30m
+//	CRON_TZ=Asia/Shanghai 0 15 3 * * *
+//
+// 字段支持* ? , - / 以及月份和星期的英文缩写; 没有指定时区时使用loc, loc为空时使用time.Local
+func ParseCron(spec string, loc *time.Location) (schedule Schedule, err error) {
+	spec = strings.TrimSpace(spec)
+	if loc == nil {
+		loc = time.Local
+	}
+	if strings.HasPrefix(spec, "CRON_TZ=") || strings.HasPrefix(spec, "TZ=") {
+		i := strings.IndexAny(spec, " \t")
+		if i < 0 {
+			return nil, cronError(spec, "missing fields after time zone")
+		}
+		name := spec[strings.Index(spec, "=")+1 : i]
+		if loc, err = time.LoadLocation(name); err != nil {
+			return nil, cronError(spec, err.Error())
+		}
+		spec = strings.TrimSpace(spec[i:])
+	}
+	if strings.HasPrefix(spec, "@every ") {
+		d, e := time.ParseDuration(strings.TrimSpace(spec[len("@every "):]))
+		if e != nil || d <= 0 {
+			return nil, cronError(spec, "invalid duration")
+		}
+		return Every(d), nil
+	}
+	if s, ok := cronDescriptors[spec]; ok {
+		spec = s
+	}
+
+	fields := strings.Fields(spec)
+	switch len(fields) {
+	case 5:
+		fields = append([]string{"0"}, fields...)
+	case 6:
+	default:
+		return nil, cronError(spec, fmt.Sprintf("expected 5 or 6 fields, got %d", len(fields)))
+	}
+	s := &cronSchedule{location: loc}
+	if s.second, _, err = secondField.parse(fields[0]); err != nil {
+		return nil, cronError(spec, err.Error())
+	}
+	if s.minute, _, err = minuteField.parse(fields[1]); err != nil {
+		return nil, cronError(spec, err.Error())
+	}
+	if s.hour, _, err = hourField.parse(fields[2]); err != nil {
+		return nil, cronError(spec, err.Error())
+	}
+	if s.dom, s.domStar, err = domField.parse(fields[3]); err != nil {
+		return nil, cronError(spec, err.Error())
+	}
+	if s.month, _, err = monthField.parse(fields[4]); err != nil {
+		return nil, cronError(spec, err.Error())
+	}
+	if s.dow, s.dowStar, err = dowField.parse(fields[5]); err != nil {
+		return nil, cronError(spec, err.Error())
+	}
+	if s.dow&(1<<7) != 0 {
+		s.dow = s.dow&^(1<<7) | 1
+	}
+	return s, nil
+}
+
+func cronError(spec string, reason string) error {
+	return errors.New(fmt.Sprintf("%v [\"%s\"]: %s", ErrCronSpec, spec, reason))
+}
+
+// 解析单个字段, star表示字段为*或?
+func (f cronField) parse(field string) (bits uint64, star bool, err error) {
+	for _, part := range strings.Split(field, ",") {
+		b, s, e := f.parsePart(part)
+		if e != nil {
+			return 0, false, e
+		}
+		bits |= b
+		star = star || s
+	}
+	return
+}
+
+func (f cronField) parsePart(part string) (bits uint64, star bool, err error) {
+	rangePart, step := part, 1
+	if i := strings.Index(part, "/"); i >= 0 {
+		rangePart = part[:i]
+		if step, err = strconv.Atoi(part[i+1:]); err != nil || step <= 0 {
+			return 0, false, errors.New(fmt.Sprintf("invalid step in \"%s\"", part))
+		}
+	}
+	var start, end int
+	switch {
+	case rangePart == "*" || rangePart == "?":
+		start, end = f.min, f.max
+		star = step == 1
+	case strings.Contains(rangePart, "-"):
+		bounds := strings.SplitN(rangePart, "-", 2)
+		if start, err = f.value(bounds[0]); err != nil {
+			return
+		}
+		if end, err = f.value(bounds[1]); err != nil {
+			return
+		}
+	default:
+		if start, err = f.value(rangePart); err != nil {
+			return
+		}
+		end = start
+		if step > 1 {
+			end = f.max
+		}
+	}
+	if start > end {
+		return 0, false, errors.New(fmt.Sprintf("invalid range \"%s\"", part))
+	}
+	for v := start; v <= end; v += step {
+		bits |= 1 << uint(v)
+	}
+	return
+}
+
+func (f cronField) value(s string) (v int, err error) {
+	if n, ok := f.names[strings.ToLower(s)]; ok {
+		return n, nil
+	}
+	if v, err = strconv.Atoi(s); err != nil {
+		return 0, errors.New(fmt.Sprintf("invalid value \"%s\"", s))
+	}
+	if v < f.min || v > f.max {
+		return 0, errors.New(fmt.Sprintf("value %d out of range [%d, %d]", v, f.min, f.max))
+	}
+	return
+}
+
+func (s *cronSchedule) dayMatches(t time.Time) bool {
+	domMatch := s.dom&(1<<uint(t.Day())) != 0
+	dowMatch := s.dow&(1<<uint(t.Weekday())) != 0
+	if s.domStar || s.dowStar {
+		return domMatch && dowMatch
+	}
+	return domMatch || dowMatch
+}
+
+// 从t的下一秒开始逐级匹配月、日、时、分、秒, 最多向后查找5年
+func (s *cronSchedule) Next(t time.Time) time.Time {
+	origLoc := t.Location()
+	t = t.In(s.location)
+	t = t.Add(time.Second - time.Duration(t.Nanosecond()))
+	yearLimit := t.Year() + 5
+	added := false
+
+WRAP:
+	if t.Year() > yearLimit {
+		return time.Time{}
+	}
+	for s.month&(1<<uint(t.Month())) == 0 {
+		if !added {
+			added = true
+			t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, s.location)
+		}
+		t = t.AddDate(0, 1, 0)
+		if t.Month() == time.January {
+			goto WRAP
+		}
+	}
+	for !s.dayMatches(t) {
+		if !added {
+			added = true
+			t = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, s.location)
+		}
+		t = t.AddDate(0, 0, 1)
+		if t.Day() == 1 {
+			goto WRAP
+		}
+	}
+	for s.hour&(1<<uint(t.Hour())) == 0 {
+		if !added {
+			added = true
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, s.location)
+		}
+		t = t.Add(time.Hour)
+		if t.Hour() == 0 {
+			goto WRAP
+		}
+	}
+	for s.minute&(1<<uint(t.Minute())) == 0 {
+		if !added {
+			added = true
+			t = t.Truncate(time.Minute)
+		}
+		t = t.Add(time.Minute)
+		if t.Minute() == 0 {
+			goto WRAP
+		}
+	}
+	for s.second&(1<<uint(t.Second())) == 0 {
+		if !added {
+			added = true
+			t = t.Truncate(time.Second)
+		}
+		t = t.Add(time.Second)
+		if t.Second() == 0 {
+			goto WRAP
+		}
+	}
+	return t.In(origLoc)
+}
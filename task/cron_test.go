@@ -0,0 +1,53 @@
+package task
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ParseCron(t *testing.T) {
+	shanghai, err := time.LoadLocation("Asia/Shanghai")
+	if err != nil {
+		t.Skip(err)
+	}
+	// 2024-01-10 周三
+	from := time.Date(2024, 1, 10, 12, 30, 15, 500, time.UTC)
+	cases := []struct {
+		spec string
+		want time.Time
+	}{
+		{"15 3 * * *", time.Date(2024, 1, 11, 3, 15, 0, 0, time.UTC)},
+		{"0 * * * 1-5", time.Date(2024, 1, 10, 13, 0, 0, 0, time.UTC)},
+		{"*/20 * * * * *", time.Date(2024, 1, 10, 12, 30, 20, 0, time.UTC)},
+		{"0 0 9 * * sat,sun", time.Date(2024, 1, 13, 9, 0, 0, 0, time.UTC)},
+		{"0 0 1 1 *", time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 * *", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 feb *", time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		// 日和星期都指定时满足其一即可
+		{"0 0 15 * 5", time.Date(2024, 1, 12, 0, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2024, 1, 14, 0, 0, 0, 0, time.UTC)},
+		{"@daily", time.Date(2024, 1, 11, 0, 0, 0, 0, time.UTC)},
+		{"@every 90m", from.Add(90 * time.Minute)},
+		{"CRON_TZ=Asia/Shanghai 15 3 * * *", time.Date(2024, 1, 11, 3, 15, 0, 0, shanghai)},
+	}
+	for _, c := range cases {
+		s, err := ParseCron(c.spec, time.UTC)
+		if err != nil {
+			t.Fatalf("ParseCron(%q) error: %v", c.spec, err)
+		}
+		if got := s.Next(from); !got.Equal(c.want) {
+			t.Errorf("ParseCron(%q).Next = %v, want %v", c.spec, got, c.want)
+		}
+	}
+
+	s, _ := ParseCron("15 3 * * *", shanghai)
+	if got, want := s.Next(from), time.Date(2024, 1, 11, 3, 15, 0, 0, shanghai); !got.Equal(want) {
+		t.Errorf("location Next = %v, want %v", got, want)
+	}
+
+	for _, spec := range []string{"", "* * * *", "60 * * * *", "* * 32 * *", "5-1 * * * *", "*/0 * * * *", "* * * foo *", "TZ=Nowhere/City * * * * *"} {
+		if _, err := ParseCron(spec, nil); err == nil {
+			t.Errorf("ParseCron(%q) should fail", spec)
+		}
+	}
+}
@@ -1,7 +1,6 @@
 package task
 
 import (
-	"errors"
 	"net/http"
 	"sync"
 	"sync/atomic"
@@ -17,13 +16,13 @@ var (
 
 type HTTPTask struct {
 	Id         int32
-	Gid        uint64
 	Pattern    string
 	Handler    http.Handler
 	FuncName   string
 	State      taskState
 	timeOut    time.Duration
 	isFinished chan bool
+	runState   int32
 }
 
 func NewHTTPTask(pattern string) (task *HTTPTask, err error) {
@@ -37,7 +36,7 @@ func NewHTTPTask(pattern string) (task *HTTPTask, err error) {
 		Handler:    taskHandle.handler,
 		State:      stateNew,
 		timeOut:    taskHandle.timeOut,
-		isFinished: make(chan bool),
+		isFinished: make(chan bool, 1),
 	}
 	httpTaskPoolMu.Lock()
 	httpTaskPool[task.Id] = task
@@ -45,13 +44,18 @@ func NewHTTPTask(pattern string) (task *HTTPTask, err error) {
 	return
 }
 
+// handler通过r.Context()感知取消, 超时或客户端断开时取消;
+// 超时后Run立即返回, handler不应再使用rw
 func (t *HTTPTask) Run(rw http.ResponseWriter, r *http.Request) (res []byte, err error) {
 	t.setState(stateRun)
+	t.FuncName = GetTaskFuncName(t.Handler)
+	ctx, cancel := taskContext(r.Context(), t.timeOut)
+	defer cancel()
+	ctx = withTaskInfo(ctx, &TaskInfo{Type: TaskTypeHTTP, Id: t.Id, FuncName: t.FuncName})
+	r = r.WithContext(ctx)
 
-	funcName := GetTaskFuncName(t.Handler)
 	go func() {
-		t.Gid = common.GetGID()
-		t.FuncName = funcName
+		defer finishTask(&t.runState)
 		if common.CheckWrapPanic() {
 			common.GoSafeHTTP(rw, r, t.Handler.ServeHTTP)
 		} else {
@@ -60,21 +64,13 @@ func (t *HTTPTask) Run(rw http.ResponseWriter, r *http.Request) (res []byte, err
 		t.isFinished <- true
 	}()
 
-	if t.timeOut > 0 {
-		select {
-		case <-t.isFinished:
-			t.setState(stateFinished)
-		case <-time.After(t.timeOut):
-			t.setState(stateFinished)
-			err = errors.New("task timet out")
-
-		}
-	} else {
-		select {
-		case <-t.isFinished:
-			t.setState(stateFinished)
-		}
+	select {
+	case <-t.isFinished:
+	case <-ctx.Done():
+		abandonTask(&t.runState)
+		err = taskContextError(ctx)
 	}
+	t.setState(stateFinished)
 
 	httpTaskPoolMu.Lock()
 	delete(httpTaskPool, t.Id)
@@ -90,17 +86,6 @@ func LenHTTPTasks() int {
 	return len(httpTaskPool)
 }
 
-func GetHTTPTaskByGid(gid uint64) (task interface{}) {
-	httpTaskPoolMu.Lock()
-	defer httpTaskPoolMu.Unlock()
-	for _, t := range httpTaskPool {
-		if t.Gid == gid {
-			return t
-		}
-	}
-	return nil
-}
-
 func DumpHTTPTasks() (tasks map[int32]*HTTPTask) {
 	tasks = make(map[int32]*HTTPTask)
 	httpTaskPoolMu.Lock()
@@ -0,0 +1,94 @@
+package task
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/vmihailenco/msgpack/v4"
+	"google.golang.org/protobuf/proto"
+)
+
+// 请求/回包的序列化方式
+type Serializer interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// 不是google.golang.org/protobuf消息时ProtoSerializer使用该接口,
+// gogo/protobuf、vtprotobuf等生成的代码实现了该接口
+type ProtoMessage interface {
+	Marshal() ([]byte, error)
+	Unmarshal(data []byte) error
+}
+
+var (
+	JSONSerializer    Serializer = jsonSerializer{}
+	ProtoSerializer   Serializer = protoSerializer{}
+	MsgpackSerializer Serializer = msgpackSerializer{}
+)
+
+var ErrNotProtoMessage = errors.New("not a proto message")
+
+// 用一对序列化函数构造Serializer
+func NewSerializer(marshal func(v interface{}) ([]byte, error), unmarshal func(data []byte, v interface{}) error) Serializer {
+	return &funcSerializer{marshal: marshal, unmarshal: unmarshal}
+}
+
+type funcSerializer struct {
+	marshal   func(v interface{}) ([]byte, error)
+	unmarshal func(data []byte, v interface{}) error
+}
+
+func (s *funcSerializer) Marshal(v interface{}) ([]byte, error) {
+	return s.marshal(v)
+}
+
+func (s *funcSerializer) Unmarshal(data []byte, v interface{}) error {
+	return s.unmarshal(data, v)
+}
+
+type jsonSerializer struct{}
+
+func (jsonSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+type protoSerializer struct{}
+
+// 优先按google.golang.org/protobuf的proto.Message处理, 否则使用ProtoMessage接口
+func (protoSerializer) Marshal(v interface{}) ([]byte, error) {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Marshal(m)
+	}
+	m, ok := v.(ProtoMessage)
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("%v: %T", ErrNotProtoMessage, v))
+	}
+	return m.Marshal()
+}
+
+func (protoSerializer) Unmarshal(data []byte, v interface{}) error {
+	if m, ok := v.(proto.Message); ok {
+		return proto.Unmarshal(data, m)
+	}
+	m, ok := v.(ProtoMessage)
+	if !ok {
+		return errors.New(fmt.Sprintf("%v: %T", ErrNotProtoMessage, v))
+	}
+	return m.Unmarshal(data)
+}
+
+type msgpackSerializer struct{}
+
+func (msgpackSerializer) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+func (msgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
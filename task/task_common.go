@@ -1,11 +1,14 @@
 package task
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"reflect"
 	"runtime"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/xuhn/optimusprime/common"
@@ -20,6 +23,27 @@ const (
 	stateFinished
 )
 
+var (
+	ErrTaskTimeout  = errors.New("task timet out")
+	ErrTaskClosed   = errors.New("task fail ,close")
+	ErrTaskCanceled = errors.New("task canceled")
+)
+
+// 任务handler的运行状态
+const (
+	taskRunning int32 = iota
+	taskDone
+	// 超时或取消后Run已返回, handler仍在运行
+	taskAbandoned
+)
+
+var (
+	// 累计被放弃的任务数
+	abandonedTasks uint64
+	// 被放弃后handler仍未返回的任务数
+	abandonedRunningTasks int64
+)
+
 var (
 	globalTaskId       int32
 	taskStatServeOnce  *sync.Once    = &sync.Once{}
@@ -29,61 +53,81 @@ var (
 
 // 根据handler获取任务方法名字
 func GetTaskFuncName(taskHandler interface{}) string {
+	if h, ok := taskHandler.(interface{ funcName() string }); ok {
+		return h.funcName()
+	}
 	funcInfo := runtime.FuncForPC(reflect.ValueOf(taskHandler).Pointer()).Name()
-	return strings.Split(funcInfo, ".")[1]
+	// 去掉包路径, 包路径中可能含有"."
+	funcInfo = funcInfo[strings.LastIndex(funcInfo, "/")+1:]
+	return strings.SplitN(funcInfo, ".", 2)[1]
 }
 
-// 根据Goroutine Id 获取任务实例
-func GetTaskByGid(gid uint64) (task interface{}) {
-	task = GetTCPTaskByGid(gid)
-	if task != nil {
-		return
+// 任务上下文, parent结束或超过timeOut后取消; timeOut为0时只跟随parent
+func taskContext(parent context.Context, timeOut time.Duration) (context.Context, context.CancelFunc) {
+	if parent == nil {
+		parent = context.Background()
 	}
-	task = GetTimerTaskByGid(gid)
-	if task != nil {
-		return
+	if timeOut > 0 {
+		return context.WithTimeout(parent, timeOut)
 	}
-	task = GetHTTPTaskByGid(gid)
-	return
+	return context.WithCancel(parent)
+}
+
+// ctx结束对应的任务错误
+func taskContextError(ctx context.Context) error {
+	if ctx.Err() == context.DeadlineExceeded {
+		return ErrTaskTimeout
+	}
+	return ErrTaskCanceled
+}
+
+// handler返回时调用
+func finishTask(state *int32) {
+	if !atomic.CompareAndSwapInt32(state, taskRunning, taskDone) {
+		atomic.AddInt64(&abandonedRunningTasks, -1)
+	}
+}
+
+// Run因超时或取消返回时调用, handler已返回的不计入
+func abandonTask(state *int32) {
+	if atomic.CompareAndSwapInt32(state, taskRunning, taskAbandoned) {
+		atomic.AddUint64(&abandonedTasks, 1)
+		atomic.AddInt64(&abandonedRunningTasks, 1)
+	}
+}
+
+// 累计被放弃(超时或取消时handler仍在运行)的任务数
+func AbandonedTasks() uint64 {
+	return atomic.LoadUint64(&abandonedTasks)
+}
+
+// 被放弃后handler仍未返回的任务数, 持续增长说明有handler没有响应ctx的取消
+func RunningAbandonedTasks() int64 {
+	return atomic.LoadInt64(&abandonedRunningTasks)
 }
 
 // ===================================================================================
-// 任务日志
-func T_DEBUGF(format string, v ...interface{}) {
-	taskLog("DEBUG", format, v...)
+// 任务日志, 从ctx中获取任务信息, 格式[xxx(xxx)|func(xxx)]
+func T_DEBUGF(ctx context.Context, format string, v ...interface{}) {
+	taskLog(ctx, "DEBUG", format, v...)
 }
 
-func T_NFOF(format string, v ...interface{}) {
-	taskLog("INFO", format, v...)
+func T_NFOF(ctx context.Context, format string, v ...interface{}) {
+	taskLog(ctx, "INFO", format, v...)
 }
 
-func T_WARNF(format string, v ...interface{}) {
-	taskLog("WARN", format, v...)
+func T_WARNF(ctx context.Context, format string, v ...interface{}) {
+	taskLog(ctx, "WARN", format, v...)
 }
 
-func T_ERRORF(format string, v ...interface{}) {
-	taskLog("ERROR", format, v...)
+func T_ERRORF(ctx context.Context, format string, v ...interface{}) {
+	taskLog(ctx, "ERROR", format, v...)
 }
 
-func taskLog(level string, format string, v ...interface{}) {
-	var newFormat string
-	// 根据goroutine id获取task 信息
-	gid := common.GetGID()
-	task := GetTaskByGid(gid)
-	// 解析对应的task信息并写入日志,格式[xxx(xxx)|func(xxx)]
-	switch task.(type) {
-	case *TCPTask:
-		tcpTask := task.(*TCPTask)
-		funcName := tcpTask.FuncName
-		newFormat = fmt.Sprintf("[TCP_TASK(%d)|%s] %s", tcpTask.Id, funcName, format)
-	case *TimerTask:
-		timerTask := task.(*TimerTask)
-		funcName := timerTask.FuncName
-		newFormat = fmt.Sprintf("[TIMER_TASK(%d)|%s] %s", timerTask.Id, funcName, format)
-	case *HTTPTask:
-		httpTask := task.(*HTTPTask)
-		funcName := httpTask.FuncName
-		newFormat = fmt.Sprintf("[HTTP_TASK(%d)|%s] %s", httpTask.Id, funcName, format)
+func taskLog(ctx context.Context, level string, format string, v ...interface{}) {
+	newFormat := format
+	if info, ok := TaskFromContext(ctx); ok {
+		newFormat = fmt.Sprintf("[%s(%d)|%s] %s", info.Type, info.Id, info.FuncName, format)
 	}
 
 	switch level {
@@ -0,0 +1,55 @@
+package task
+
+import (
+	"context"
+
+	"github.com/xuhn/optimusprime/common"
+)
+
+// 任务类型, 用于日志和统计
+const (
+	TaskTypeTCP   = "TCP_TASK"
+	TaskTypeTimer = "TIMER_TASK"
+	TaskTypeHTTP  = "HTTP_TASK"
+	TaskTypeAPI   = "API_TASK"
+	TaskTypeWs    = "WS_TASK"
+)
+
+// 通过ctx传递给handler的任务信息
+type TaskInfo struct {
+	Type     string
+	Id       int32
+	FuncName string
+}
+
+// 断开时关闭Done()的连接, 如*net.TcpConnection、*websocket.Conn
+type doneConn interface {
+	Done() <-chan struct{}
+}
+
+type taskInfoKey struct{}
+
+func withTaskInfo(ctx context.Context, info *TaskInfo) context.Context {
+	return context.WithValue(ctx, taskInfoKey{}, info)
+}
+
+// 获取ctx所属的任务, handler收到的ctx及其派生的ctx都带有任务信息
+func TaskFromContext(ctx context.Context) (info *TaskInfo, ok bool) {
+	if ctx == nil {
+		return nil, false
+	}
+	info, ok = ctx.Value(taskInfoKey{}).(*TaskInfo)
+	return
+}
+
+// 启动子goroutine, fn收到的ctx继承任务信息和取消;
+// 开启panic保护时与handler一样recover
+func Go(ctx context.Context, fn func(ctx context.Context)) {
+	go func() {
+		if common.CheckWrapPanic() {
+			common.GoSafeContext(ctx, fn)
+		} else {
+			fn(ctx)
+		}
+	}()
+}
@@ -0,0 +1,93 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xuhn/optimusprime/log"
+)
+
+func Test_GoInheritsTask(t *testing.T) {
+	type childResult struct {
+		info     *TaskInfo
+		canceled bool
+	}
+	parent := make(chan *TaskInfo, 1)
+	child := make(chan childResult, 1)
+	RegisterTCPTaskHandle(9201, TCPTaskFunc(func(ctx context.Context, c chan []byte, msg interface{}) {
+		info, _ := TaskFromContext(ctx)
+		parent <- info
+		Go(ctx, func(ctx context.Context) {
+			info, _ := TaskFromContext(ctx)
+			select {
+			case <-ctx.Done():
+				child <- childResult{info: info, canceled: true}
+			case <-time.After(time.Second):
+				child <- childResult{info: info}
+			}
+		})
+		<-ctx.Done()
+	}), 20*time.Millisecond)
+	task, err := NewTCPTask(9201)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = task.Run(nil); err != ErrTaskTimeout {
+		t.Fatalf("run returned %v, want ErrTaskTimeout", err)
+	}
+	want := <-parent
+	if want == nil || want.Type != TaskTypeTCP || want.Id != task.Id {
+		t.Fatalf("handler task info %+v", want)
+	}
+	got := <-child
+	if got.info != want {
+		t.Errorf("child task info %+v, want %+v", got.info, want)
+	}
+	if !got.canceled {
+		t.Error("child ctx not canceled with the task")
+	}
+}
+
+func Test_TaskLogPrefix(t *testing.T) {
+	dir, err := ioutil.TempDir("", "task_log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log.InitLogger(dir, "task_", ".log", 1, "DEBUG")
+	defer func() {
+		log.Glogger.Close()
+		log.Glogger = nil
+	}()
+
+	ctx := withTaskInfo(context.Background(), &TaskInfo{Type: TaskTypeTimer, Id: 42, FuncName: "job"})
+	T_NFOF(ctx, "with task %d", 1)
+	T_NFOF(context.Background(), "without task %d", 2)
+
+	// 日志异步写入文件
+	var out string
+	for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+		files, _ := filepath.Glob(filepath.Join(dir, "*"))
+		out = ""
+		for _, f := range files {
+			b, _ := ioutil.ReadFile(f)
+			out += string(b)
+		}
+		if strings.Contains(out, "without task 2") {
+			break
+		}
+	}
+	prefix := fmt.Sprintf("[%s(%d)|%s] with task 1", TaskTypeTimer, 42, "job")
+	if !strings.Contains(out, prefix) {
+		t.Errorf("log output %q missing %q", out, prefix)
+	}
+	if !strings.Contains(out, "without task 2") || strings.Contains(out, "|job] without task 2") {
+		t.Errorf("log output %q, want line without task prefix", out)
+	}
+}
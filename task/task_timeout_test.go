@@ -0,0 +1,118 @@
+package task
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// 超时后仍在运行的handler, 收到ctx取消后等待release才返回
+type slowHandler struct {
+	canceled chan struct{}
+	release  chan struct{}
+}
+
+func newSlowHandler() *slowHandler {
+	return &slowHandler{canceled: make(chan struct{}), release: make(chan struct{})}
+}
+
+func (h *slowHandler) wait(ctx context.Context) {
+	<-ctx.Done()
+	close(h.canceled)
+	<-h.release
+}
+
+func Test_TaskRunTimeout(t *testing.T) {
+	cases := []struct {
+		name string
+		run  func(h *slowHandler) error
+	}{
+		{"tcp", func(h *slowHandler) error {
+			RegisterTCPTaskHandle(9101, TCPTaskFunc(func(ctx context.Context, c chan []byte, msg interface{}) {
+				h.wait(ctx)
+			}), 20*time.Millisecond)
+			task, err := NewTCPTask(9101)
+			if err != nil {
+				return err
+			}
+			_, err = task.Run([]byte("req"))
+			return err
+		}},
+		{"http", func(h *slowHandler) error {
+			RegisterHTTPTaskHandle("/timeout/http", http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+				h.wait(r.Context())
+			}), 20*time.Millisecond)
+			task, err := NewHTTPTask("/timeout/http")
+			if err != nil {
+				return err
+			}
+			_, err = task.Run(httptest.NewRecorder(), httptest.NewRequest("GET", "/timeout/http", nil))
+			return err
+		}},
+		{"api", func(h *slowHandler) error {
+			RegisterAPITaskHandle("/timeout/api", APITaskFunc(func(ctx context.Context, params map[string]string) interface{} {
+				h.wait(ctx)
+				return nil
+			}), 20*time.Millisecond)
+			task, err := NewAPITask("/timeout/api")
+			if err != nil {
+				return err
+			}
+			_, err = task.Run(httptest.NewRecorder(), httptest.NewRequest("GET", "/timeout/api", nil))
+			return err
+		}},
+	}
+	for _, c := range cases {
+		abandoned, running := AbandonedTasks(), RunningAbandonedTasks()
+		h := newSlowHandler()
+		if err := c.run(h); err != ErrTaskTimeout {
+			t.Fatalf("%s run returned %v, want ErrTaskTimeout", c.name, err)
+		}
+		if AbandonedTasks() != abandoned+1 || RunningAbandonedTasks() != running+1 {
+			t.Errorf("%s abandoned %d running %d, want %d %d", c.name, AbandonedTasks(), RunningAbandonedTasks(), abandoned+1, running+1)
+		}
+		select {
+		case <-h.canceled:
+		case <-time.After(time.Second):
+			t.Fatalf("%s handler ctx not canceled", c.name)
+		}
+		close(h.release)
+		deadline := time.Now().Add(time.Second)
+		for RunningAbandonedTasks() != running && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if RunningAbandonedTasks() != running {
+			t.Errorf("%s running abandoned tasks %d after handler returned, want %d", c.name, RunningAbandonedTasks(), running)
+		}
+	}
+}
+
+type fakeWsConn struct {
+	done chan struct{}
+}
+
+func (c *fakeWsConn) Done() <-chan struct{} { return c.done }
+
+func Test_WsTaskDisconnect(t *testing.T) {
+	h := newSlowHandler()
+	close(h.release)
+	RegisterWsTaskHandle("/timeout/ws", WsTaskFunc(func(ctx context.Context, c chan []byte, msg interface{}, conn interface{}) {
+		h.wait(ctx)
+	}), 0)
+	task, err := NewWsTask("/timeout/ws")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := &fakeWsConn{done: make(chan struct{})}
+	time.AfterFunc(10*time.Millisecond, func() { close(conn.done) })
+	if _, err = task.Run("msg", conn); err != ErrTaskCanceled {
+		t.Fatalf("run returned %v, want ErrTaskCanceled", err)
+	}
+	select {
+	case <-h.canceled:
+	case <-time.After(time.Second):
+		t.Fatal("handler ctx not canceled on disconnect")
+	}
+}
@@ -0,0 +1,226 @@
+package task
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/xuhn/optimusprime/log"
+	"github.com/xuhn/optimusprime/net"
+)
+
+// 回包头部的状态码, 非0时包体为错误信息
+const (
+	TCPCodeOK int32 = iota
+	// 命令字未注册
+	TCPCodeUnknownCmd
+	// 任务超时
+	TCPCodeTimeout
+	// 任务失败, 如回包序列化失败; handler未回包也未记录错误时不回包
+	TCPCodeTaskFail
+	// 请求包体反序列化失败
+	TCPCodeBadRequest
+	// typed handler返回错误
+	TCPCodeHandlerError
+)
+
+var ErrTCPHeaderLayout = errors.New("invalid tcp header layout")
+
+// 数据包头部布局, 各字段长度为0表示不存在, 否则只能为1/2/4/8字节, 命令字最长4字节;
+// 回包使用相同的头部布局, 命令字和序列号原样带回
+type TCPHeaderLayout struct {
+	// 头部长度, 包体从头部之后开始
+	Size int
+	// 命令字, 即RegisterTCPTaskHandle注册的id
+	CmdOffset int
+	CmdSize   int
+	// 序列号
+	SeqOffset int
+	SeqSize   int
+	// 状态码, 请求中忽略; 为0时错误回包无法与正常回包区分
+	CodeOffset int
+	CodeSize   int
+	// 为空时使用大端字节序
+	ByteOrder binary.ByteOrder
+}
+
+// 默认头部: 4字节命令字 + 4字节序列号 + 4字节状态码, 大端
+var DefaultTCPHeaderLayout = TCPHeaderLayout{
+	Size:       12,
+	CmdOffset:  0,
+	CmdSize:    4,
+	SeqOffset:  4,
+	SeqSize:    4,
+	CodeOffset: 8,
+	CodeSize:   4,
+}
+
+// 传给TCPTaskHandler.ServeTCP的请求
+type TCPRequest struct {
+	Conn   *net.TcpConnection
+	Cmd    int32
+	Seq    uint64
+	Header []byte
+	Body   []byte
+}
+
+// 按命令字将数据包分发到注册的TCPTaskHandler, 将handler的回包加上头部后发回
+type TCPDispatcher struct {
+	layout TCPHeaderLayout
+}
+
+// layout为空时使用DefaultTCPHeaderLayout
+func NewTCPDispatcher(layout *TCPHeaderLayout) (d *TCPDispatcher, err error) {
+	d = &TCPDispatcher{layout: DefaultTCPHeaderLayout}
+	if layout != nil {
+		d.layout = *layout
+	}
+	if d.layout.ByteOrder == nil {
+		d.layout.ByteOrder = binary.BigEndian
+	}
+	if err = d.layout.check(); err != nil {
+		return nil, err
+	}
+	return
+}
+
+func (l *TCPHeaderLayout) check() error {
+	if l.CmdSize == 0 {
+		return errors.New(fmt.Sprintf("%v: cmd field is required", ErrTCPHeaderLayout))
+	}
+	if l.CmdSize > 4 {
+		return errors.New(fmt.Sprintf("%v: cmd field size %d exceeds int32", ErrTCPHeaderLayout, l.CmdSize))
+	}
+	fields := [][2]int{{l.CmdOffset, l.CmdSize}, {l.SeqOffset, l.SeqSize}, {l.CodeOffset, l.CodeSize}}
+	for _, f := range fields {
+		offset, size := f[0], f[1]
+		if size == 0 {
+			continue
+		}
+		if size != 1 && size != 2 && size != 4 && size != 8 {
+			return errors.New(fmt.Sprintf("%v: field size %d", ErrTCPHeaderLayout, size))
+		}
+		if offset < 0 || offset+size > l.Size {
+			return errors.New(fmt.Sprintf("%v: field [%d, %d) out of header size %d", ErrTCPHeaderLayout, offset, offset+size, l.Size))
+		}
+	}
+	return nil
+}
+
+func (l *TCPHeaderLayout) getField(header []byte, offset, size int) uint64 {
+	b := header[offset : offset+size]
+	switch size {
+	case 1:
+		return uint64(b[0])
+	case 2:
+		return uint64(l.ByteOrder.Uint16(b))
+	case 4:
+		return uint64(l.ByteOrder.Uint32(b))
+	case 8:
+		return l.ByteOrder.Uint64(b)
+	}
+	return 0
+}
+
+func (l *TCPHeaderLayout) putField(header []byte, offset, size int, v uint64) {
+	b := header[offset : offset+size]
+	switch size {
+	case 1:
+		b[0] = byte(v)
+	case 2:
+		l.ByteOrder.PutUint16(b, uint16(v))
+	case 4:
+		l.ByteOrder.PutUint32(b, uint32(v))
+	case 8:
+		l.ByteOrder.PutUint64(b, v)
+	}
+}
+
+// 解析请求头部
+func (d *TCPDispatcher) Parse(msg []byte) (req *TCPRequest, err error) {
+	l := &d.layout
+	if len(msg) < l.Size {
+		return nil, errors.New(fmt.Sprintf("tcp frame too short: %d < header size %d", len(msg), l.Size))
+	}
+	req = &TCPRequest{
+		Cmd:    int32(l.getField(msg, l.CmdOffset, l.CmdSize)),
+		Header: msg[:l.Size],
+		Body:   msg[l.Size:],
+	}
+	if l.SeqSize > 0 {
+		req.Seq = l.getField(msg, l.SeqOffset, l.SeqSize)
+	}
+	return
+}
+
+// 构造回包, 头部中命令字/序列号与请求相同, 其余字段为0
+func (d *TCPDispatcher) Response(req *TCPRequest, code int32, body []byte) []byte {
+	l := &d.layout
+	res := make([]byte, l.Size+len(body))
+	l.putField(res, l.CmdOffset, l.CmdSize, uint64(uint32(req.Cmd)))
+	if l.SeqSize > 0 {
+		l.putField(res, l.SeqOffset, l.SeqSize, req.Seq)
+	}
+	if l.CodeSize > 0 {
+		l.putField(res, l.CodeOffset, l.CodeSize, uint64(uint32(code)))
+	}
+	copy(res[l.Size:], body)
+	return res
+}
+
+// 可直接作为net.OnDataIn或TCPHooks.OnDataIn使用; handler未回包也未记录错误时不回包
+func (d *TCPDispatcher) OnDataIn(conn *net.TcpConnection, msg []byte) {
+	req, err := d.Parse(msg)
+	if err != nil {
+		log.WARNF("connection [ %s ] drop frame: %v", conn.Conn().RemoteAddr(), err)
+		return
+	}
+	req.Conn = conn
+	ctx, cancel := connContext(context.Background(), conn)
+	defer cancel()
+	code, res, reply := d.serve(ctx, req)
+	if !reply || conn.IsClosed() {
+		return
+	}
+	if err = net.SendTCPResponse(conn, d.Response(req, code, res)); err != nil {
+		log.WARNF("connection [ %s ] send response cmd(%d) seq(%d) fail:%v", conn.Conn().RemoteAddr(), req.Cmd, req.Seq, err)
+	}
+}
+
+// 连接断开时取消的上下文, conn为*net.TcpConnection或*websocket.Conn
+func connContext(parent context.Context, conn doneConn) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+	go func() {
+		select {
+		case <-conn.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	return ctx, cancel
+}
+
+// reply为false表示handler未回包也未记录错误, 不需要回包
+func (d *TCPDispatcher) serve(ctx context.Context, req *TCPRequest) (code int32, res []byte, reply bool) {
+	t, err := NewTCPTask(req.Cmd)
+	if err != nil {
+		log.WARNF("unknown cmd(%d) seq(%d)", req.Cmd, req.Seq)
+		return TCPCodeUnknownCmd, []byte(fmt.Sprintf("unknown cmd %d", req.Cmd)), true
+	}
+	if res, err = t.RunContext(ctx, req); err != nil {
+		if te, ok := err.(*TCPError); ok {
+			log.WARNF("task cmd(%d) seq(%d) fail:%v", req.Cmd, req.Seq, te)
+			return te.Code, []byte(te.Msg), true
+		}
+		if err == ErrTaskClosed {
+			return TCPCodeOK, nil, false
+		}
+		log.WARNF("task cmd(%d) seq(%d) fail:%v", req.Cmd, req.Seq, err)
+		if err == ErrTaskTimeout {
+			return TCPCodeTimeout, []byte(err.Error()), true
+		}
+		return TCPCodeTaskFail, []byte(err.Error()), true
+	}
+	return TCPCodeOK, res, true
+}
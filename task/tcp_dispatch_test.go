@@ -0,0 +1,29 @@
+package task
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// handler未回包也未记录错误时不回包, 失败时回包带状态码
+func Test_TCPDispatcherNoReply(t *testing.T) {
+	RegisterTCPTaskHandle(9501, TCPTaskFunc(func(ctx context.Context, c chan []byte, msg interface{}) {}), time.Second)
+	d, _ := NewTCPDispatcher(nil)
+	if _, _, reply := d.serve(context.Background(), &TCPRequest{Cmd: 9501}); reply {
+		t.Error("reply sent for handler without response")
+	}
+	if code, _, reply := d.serve(context.Background(), &TCPRequest{Cmd: 9599}); !reply || code != TCPCodeUnknownCmd {
+		t.Errorf("unknown cmd: code %d reply %v", code, reply)
+	}
+}
+
+// 命令字为int32, 不支持8字节
+func Test_TCPHeaderLayoutCheck(t *testing.T) {
+	for size, ok := range map[int]bool{1: true, 2: true, 4: true, 8: false, 3: false} {
+		_, err := NewTCPDispatcher(&TCPHeaderLayout{Size: 8, CmdSize: size})
+		if (err == nil) != ok {
+			t.Errorf("cmd size %d: err %v", size, err)
+		}
+	}
+}
@@ -1,7 +1,7 @@
 package task
 
 import (
-	"errors"
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -16,13 +16,13 @@ var (
 
 type TCPTask struct {
 	Id       int32
-	Gid      uint64
 	Type     int32
 	Handler  TCPTaskHandler
 	FuncName string
 	State    taskState
 	timeOut  time.Duration
 	msgChan  chan []byte
+	runState int32
 }
 
 func NewTCPTask(tType int32) (task *TCPTask, err error) {
@@ -36,7 +36,7 @@ func NewTCPTask(tType int32) (task *TCPTask, err error) {
 		Handler: taskHandle.handler,
 		State:   stateNew,
 		timeOut: taskHandle.timeOut,
-		msgChan: make(chan []byte),
+		msgChan: make(chan []byte, 1),
 	}
 	tcpTaskPoolMu.Lock()
 	tcpTaskPool[task.Id] = task
@@ -45,40 +45,50 @@ func NewTCPTask(tType int32) (task *TCPTask, err error) {
 }
 
 func (t *TCPTask) Run(req interface{}) (res []byte, err error) {
+	return t.RunContext(context.Background(), req)
+}
+
+// ctx取消或超时后立即返回, handler通过ctx感知取消; 回包channel有缓冲, 被放弃的handler不会阻塞
+func (t *TCPTask) RunContext(ctx context.Context, req interface{}) (res []byte, err error) {
 	t.setState(stateRun)
-	funcName := GetTaskFuncName(t.Handler)
-	var ok bool
+	t.FuncName = GetTaskFuncName(t.Handler)
+	ctx, cancel := taskContext(ctx, t.timeOut)
+	defer cancel()
+	ctx = withTaskInfo(ctx, &TaskInfo{Type: TaskTypeTCP, Id: t.Id, FuncName: t.FuncName})
+	ctx, slot := withTCPErrorSlot(ctx)
+	done := make(chan struct{})
 	go func() {
-		t.Gid = common.GetGID()
-		t.FuncName = funcName
+		defer close(done)
+		defer finishTask(&t.runState)
 		if common.CheckWrapPanic() {
-			common.GoSafeTCP(t.msgChan, req, t.Handler.ServeTCP)
+			common.GoSafeTCP(ctx, t.msgChan, req, t.Handler.ServeTCP)
 		} else {
-			t.Handler.ServeTCP(t.msgChan, req)
+			t.Handler.ServeTCP(ctx, t.msgChan, req)
 		}
 	}()
 
-	if t.timeOut > 0 {
+	var ok bool
+	select {
+	case res, ok = <-t.msgChan:
+	case <-done:
+		// handler返回时可能已写入回包
 		select {
 		case res, ok = <-t.msgChan:
-			if !ok {
-				err = errors.New("task fail ,close")
-			}
-			t.setState(stateFinished)
-		case <-time.After(t.timeOut):
-			t.setState(stateFinished)
-			err = errors.New("task timet out")
-
+		default:
 		}
-	} else {
-		select {
-		case res, ok = <-t.msgChan:
-			if !ok {
-				err = errors.New("task fail ,close")
-			}
-			t.setState(stateFinished)
+	case <-ctx.Done():
+		abandonTask(&t.runState)
+		err = taskContextError(ctx)
+	}
+	if !ok && err == nil {
+		// channel关闭后读取handler记录的错误
+		if slot.err != nil {
+			err = slot.err
+		} else {
+			err = ErrTaskClosed
 		}
 	}
+	t.setState(stateFinished)
 	tcpTaskPoolMu.Lock()
 	delete(tcpTaskPool, t.Id)
 	tcpTaskPoolMu.Unlock()
@@ -93,17 +103,6 @@ func LenTCPTasks() int {
 	return len(tcpTaskPool)
 }
 
-func GetTCPTaskByGid(gid uint64) (task interface{}) {
-	tcpTaskPoolMu.Lock()
-	defer tcpTaskPoolMu.Unlock()
-	for _, t := range tcpTaskPool {
-		if t.Gid == gid {
-			return t
-		}
-	}
-	return nil
-}
-
 func DumpTCPTasks() (tasks map[int32]*TCPTask) {
 	tasks = make(map[int32]*TCPTask)
 	tcpTaskPoolMu.Lock()
@@ -1,20 +1,24 @@
 package task
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 )
 
+var ErrTCPTaskHandleNotFound = errors.New("can't find  handle")
+
+// 回包写入c(最多一次), 不回包时关闭c; ctx在超时、调用方取消或连接断开时取消
 type TCPTaskHandler interface {
-	ServeTCP(c chan []byte, msg interface{})
+	ServeTCP(ctx context.Context, c chan []byte, msg interface{})
 }
 
-type TCPTaskFunc func(c chan []byte, msg interface{})
+type TCPTaskFunc func(ctx context.Context, c chan []byte, msg interface{})
 
-func (t TCPTaskFunc) ServeTCP(c chan []byte, msg interface{}) {
-	t(c, msg)
+func (t TCPTaskFunc) ServeTCP(ctx context.Context, c chan []byte, msg interface{}) {
+	t(ctx, c, msg)
 }
 
 type tcpTaskHandle struct {
@@ -43,7 +47,7 @@ func GetTCPTaskHandle(id int32) (*tcpTaskHandle, error) {
 	if handle, ok := tcpHandlePool[id]; ok {
 		return handle, nil
 	} else {
-		return nil, errors.New("can't find  handle")
+		return nil, ErrTCPTaskHandleNotFound
 	}
 }
 
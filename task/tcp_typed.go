@@ -0,0 +1,166 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"time"
+)
+
+var (
+	contextType    = reflect.TypeOf((*context.Context)(nil)).Elem()
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+	tcpRequestType = reflect.TypeOf((*TCPRequest)(nil))
+)
+
+// 带状态码的错误, typed handler返回该错误时回包使用其中的状态码
+type TCPError struct {
+	Code int32
+	Msg  string
+}
+
+func NewTCPError(code int32, msg string) *TCPError {
+	return &TCPError{Code: code, Msg: msg}
+}
+
+func (e *TCPError) Error() string {
+	return fmt.Sprintf("code %d: %s", e.Code, e.Msg)
+}
+
+type tcpErrorKey struct{}
+
+// TCPTask.RunContext通过ctx传给handler, typed handler失败时记录原因
+type tcpErrorSlot struct {
+	err *TCPError
+}
+
+func withTCPErrorSlot(ctx context.Context) (context.Context, *tcpErrorSlot) {
+	slot := &tcpErrorSlot{}
+	return context.WithValue(ctx, tcpErrorKey{}, slot), slot
+}
+
+// 按请求/回包类型注册的handler, 由RegisterTCPTypedHandle生成
+type typedTCPHandler struct {
+	fn         reflect.Value
+	name       string
+	withCtx    bool
+	withReq    bool
+	reqType    reflect.Type
+	serializer Serializer
+}
+
+// 注册typed handler, handler形如:
+//
+//	func(req *Req) (*Res, error)
+//	func(r *TCPRequest, req *Req) (*Res, error)
+//	func(ctx context.Context, req *Req) (*Res, error)
+//	func(ctx context.Context, r *TCPRequest, req *Req) (*Res, error)
+//
+// 请求包体按serializer反序列化为Req, 返回的Res序列化后作为回包;
+// serializer为空时使用JSONSerializer. 反序列化失败回包状态码为TCPCodeBadRequest,
+// handler返回错误时为TCPCodeHandlerError, 返回*TCPError时使用其中的状态码;
+// 直接调用TCPTask.Run时以上失败返回对应的*TCPError
+func RegisterTCPTypedHandle(id int32, handler interface{}, serializer Serializer, timeOut time.Duration) (err error) {
+	h, err := newTypedTCPHandler(handler, serializer)
+	if err != nil {
+		return
+	}
+	RegisterTCPTaskHandle(id, h, timeOut)
+	return
+}
+
+func newTypedTCPHandler(handler interface{}, serializer Serializer) (h *typedTCPHandler, err error) {
+	fn := reflect.ValueOf(handler)
+	t := fn.Type()
+	if t.Kind() != reflect.Func {
+		return nil, errors.New(fmt.Sprintf("tcp typed handler must be a func, got %T", handler))
+	}
+	if t.NumOut() != 2 || !t.Out(1).Implements(errorType) {
+		return nil, errors.New(fmt.Sprintf("tcp typed handler %T must return (response, error)", handler))
+	}
+	h = &typedTCPHandler{
+		fn:         fn,
+		name:       GetTaskFuncName(handler),
+		serializer: serializer,
+	}
+	in := 0
+	if in < t.NumIn() && t.In(in) == contextType {
+		h.withCtx = true
+		in++
+	}
+	if in < t.NumIn() && t.In(in) == tcpRequestType {
+		h.withReq = true
+		in++
+	}
+	if t.NumIn() != in+1 {
+		return nil, errors.New(fmt.Sprintf("tcp typed handler %T has invalid arguments", handler))
+	}
+	h.reqType = t.In(in)
+	if h.serializer == nil {
+		h.serializer = JSONSerializer
+	}
+	return
+}
+
+func (h *typedTCPHandler) funcName() string {
+	return h.name
+}
+
+// msg为*TCPRequest时使用其包体, 为[]byte时直接反序列化
+func (h *typedTCPHandler) ServeTCP(ctx context.Context, c chan []byte, msg interface{}) {
+	var body []byte
+	req, _ := msg.(*TCPRequest)
+	if req != nil {
+		body = req.Body
+	} else {
+		body, _ = msg.([]byte)
+	}
+
+	arg, err := h.decode(body)
+	if err != nil {
+		h.fail(ctx, c, NewTCPError(TCPCodeBadRequest, err.Error()))
+		return
+	}
+	in := make([]reflect.Value, 0, 3)
+	if h.withCtx {
+		in = append(in, reflect.ValueOf(&ctx).Elem())
+	}
+	if h.withReq {
+		in = append(in, reflect.ValueOf(req))
+	}
+	out := h.fn.Call(append(in, arg))
+	if e, _ := out[1].Interface().(error); e != nil {
+		if te, ok := e.(*TCPError); ok {
+			h.fail(ctx, c, te)
+		} else {
+			h.fail(ctx, c, NewTCPError(TCPCodeHandlerError, e.Error()))
+		}
+		return
+	}
+	res, err := h.serializer.Marshal(out[0].Interface())
+	if err != nil {
+		h.fail(ctx, c, NewTCPError(TCPCodeTaskFail, err.Error()))
+		return
+	}
+	c <- res
+}
+
+func (h *typedTCPHandler) decode(body []byte) (arg reflect.Value, err error) {
+	if h.reqType.Kind() == reflect.Ptr {
+		arg = reflect.New(h.reqType.Elem())
+		err = h.serializer.Unmarshal(body, arg.Interface())
+		return
+	}
+	ptr := reflect.New(h.reqType)
+	err = h.serializer.Unmarshal(body, ptr.Interface())
+	return ptr.Elem(), err
+}
+
+// 记录错误后关闭channel, TCPTask.Run返回记录的错误, 分发器按其中的状态码回包
+func (h *typedTCPHandler) fail(ctx context.Context, c chan []byte, err *TCPError) {
+	if slot, _ := ctx.Value(tcpErrorKey{}).(*tcpErrorSlot); slot != nil {
+		slot.err = err
+	}
+	close(c)
+}
@@ -0,0 +1,140 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type echoReq struct {
+	Name string
+}
+
+type echoRes struct {
+	Greeting string
+}
+
+func Test_TypedHandlerSignature(t *testing.T) {
+	cases := []struct {
+		name    string
+		handler interface{}
+		ok      bool
+	}{
+		{"req", func(req *echoReq) (*echoRes, error) { return nil, nil }, true},
+		{"value req", func(req echoReq) (*echoRes, error) { return nil, nil }, true},
+		{"request", func(r *TCPRequest, req *echoReq) (*echoRes, error) { return nil, nil }, true},
+		{"ctx", func(ctx context.Context, req *echoReq) (*echoRes, error) { return nil, nil }, true},
+		{"ctx request", func(ctx context.Context, r *TCPRequest, req *echoReq) (*echoRes, error) { return nil, nil }, true},
+		{"not func", echoReq{}, false},
+		{"no error", func(req *echoReq) *echoRes { return nil }, false},
+		{"second not error", func(req *echoReq) (*echoRes, string) { return nil, "" }, false},
+		{"no req", func(ctx context.Context) (*echoRes, error) { return nil, nil }, false},
+		{"extra arg", func(req *echoReq, n int) (*echoRes, error) { return nil, nil }, false},
+		{"request after req", func(req *echoReq, r *TCPRequest) (*echoRes, error) { return nil, nil }, false},
+	}
+	for _, c := range cases {
+		_, err := newTypedTCPHandler(c.handler, nil)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: err %v, want ok %v", c.name, err, c.ok)
+		}
+	}
+}
+
+func Test_TypedHandlerCode(t *testing.T) {
+	handler := func(ctx context.Context, req *echoReq) (*echoRes, error) {
+		switch req.Name {
+		case "fail":
+			return nil, errors.New("fail")
+		case "coded":
+			return nil, NewTCPError(100, "coded")
+		}
+		return &echoRes{Greeting: "hello " + req.Name}, nil
+	}
+	if err := RegisterTCPTypedHandle(9001, handler, nil, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	d, _ := NewTCPDispatcher(nil)
+	cases := []struct {
+		body string
+		code int32
+		res  string
+	}{
+		{`{"Name":"go"}`, TCPCodeOK, `{"Greeting":"hello go"}`},
+		{`{"Name":`, TCPCodeBadRequest, ""},
+		{`{"Name":"fail"}`, TCPCodeHandlerError, "fail"},
+		{`{"Name":"coded"}`, 100, "coded"},
+	}
+	for _, c := range cases {
+		// 分发器按状态码回包
+		code, res, reply := d.serve(context.Background(), &TCPRequest{Cmd: 9001, Body: []byte(c.body)})
+		if !reply || code != c.code || (c.res != "" && string(res) != c.res) {
+			t.Errorf("dispatch %s: code %d res %q, want %d %q", c.body, code, res, c.code, c.res)
+		}
+		// 直接调用Run时返回*TCPError
+		task, _ := NewTCPTask(9001)
+		res, err := task.Run([]byte(c.body))
+		if c.code == TCPCodeOK {
+			if err != nil || string(res) != c.res {
+				t.Errorf("run %s: res %q err %v", c.body, res, err)
+			}
+			continue
+		}
+		if te, ok := err.(*TCPError); !ok || te.Code != c.code {
+			t.Errorf("run %s: err %v, want code %d", c.body, err, c.code)
+		}
+	}
+}
+
+// 实现ProtoMessage接口的消息, 模拟gogo/protobuf生成的代码
+type gogoMessage struct {
+	data string
+}
+
+func (m *gogoMessage) Marshal() ([]byte, error) {
+	return []byte(m.data), nil
+}
+
+func (m *gogoMessage) Unmarshal(data []byte) error {
+	m.data = string(data)
+	return nil
+}
+
+func Test_Serializers(t *testing.T) {
+	cases := []struct {
+		name       string
+		serializer Serializer
+		in, out    interface{}
+		equal      func(in, out interface{}) bool
+	}{
+		{"json", JSONSerializer, &echoReq{Name: "a"}, &echoReq{}, func(in, out interface{}) bool {
+			return *in.(*echoReq) == *out.(*echoReq)
+		}},
+		{"msgpack", MsgpackSerializer, &echoReq{Name: "b"}, &echoReq{}, func(in, out interface{}) bool {
+			return *in.(*echoReq) == *out.(*echoReq)
+		}},
+		{"proto", ProtoSerializer, wrapperspb.String("c"), &wrapperspb.StringValue{}, func(in, out interface{}) bool {
+			return in.(*wrapperspb.StringValue).Value == out.(*wrapperspb.StringValue).Value
+		}},
+		{"proto interface", ProtoSerializer, &gogoMessage{data: "d"}, &gogoMessage{}, func(in, out interface{}) bool {
+			return *in.(*gogoMessage) == *out.(*gogoMessage)
+		}},
+	}
+	for _, c := range cases {
+		data, err := c.serializer.Marshal(c.in)
+		if err != nil {
+			t.Fatalf("%s marshal: %v", c.name, err)
+		}
+		if err = c.serializer.Unmarshal(data, c.out); err != nil {
+			t.Fatalf("%s unmarshal: %v", c.name, err)
+		}
+		if !c.equal(c.in, c.out) {
+			t.Errorf("%s: got %v, want %v", c.name, c.out, c.in)
+		}
+	}
+	if _, err := ProtoSerializer.Marshal(&echoReq{}); err == nil {
+		t.Error("proto serializer accepted non proto message")
+	}
+}
@@ -0,0 +1,174 @@
+package task
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/xuhn/optimusprime/log"
+)
+
+// 定时任务分布式锁, 多个实例注册同一任务时保证每次调度只有一个实例执行
+// owner为任务在每个实例中的唯一标识, 锁在ttl之后过期, 执行时间较长的任务会定期续约;
+// 执行完成后锁保留到下一次调度时间, 其他实例稍晚触发同一次调度时不会重复执行
+type Locker interface {
+	// 获取锁, 锁被其他owner持有且未过期时返回false
+	Lock(key string, owner string, ttl time.Duration) (ok bool, err error)
+	// 续约, 锁已不属于owner时返回false
+	Renew(key string, owner string, ttl time.Duration) (ok bool, err error)
+	// 释放锁, 锁已不属于owner时忽略
+	Unlock(key string, owner string) (err error)
+}
+
+const (
+	defaultTimerLockTTL = 30 * time.Second
+	// 续约间隔为ttl/3, 过短的租约会频繁续约
+	minTimerLockTTL = time.Second
+)
+
+var ErrTimerTaskLocked = errors.New("timer task locked by other instance")
+
+// singleton任务默认使用的锁, 为空时只在进程内保证单例
+var timerLocker Locker
+
+// 设置singleton定时任务默认使用的锁, 需在TimerTaskServe之前调用
+// TimerOptions.Locker优先, 非singleton任务只使用TimerOptions.Locker
+func SetTimerLocker(locker Locker) {
+	timerLocker = locker
+}
+
+// 任务使用的锁, 没有锁时返回nil
+func (h *timerTaskHandle) timerLock(tType int32) (locker Locker, key string, ttl time.Duration) {
+	locker = h.locker
+	if locker == nil && h.singleton {
+		locker = timerLocker
+	}
+	if locker == nil {
+		return
+	}
+	key = h.lockKey
+	if key == "" {
+		key = fmt.Sprintf("timer_task_%d", tType)
+	}
+	ttl = h.lockTTL
+	if ttl <= 0 {
+		ttl = defaultTimerLockTTL
+	} else if ttl < minTimerLockTTL {
+		ttl = minTimerLockTTL
+	}
+	return
+}
+
+// 获取锁, 同一实例中上一次执行未结束时返回false
+func (h *timerTaskHandle) lock(locker Locker, key string, ttl time.Duration) (ok bool, err error) {
+	if !atomic.CompareAndSwapInt32(&h.lockRunning, 0, 1) {
+		return false, nil
+	}
+	if ok, err = locker.Lock(key, h.lockOwner, ttl); err != nil || !ok {
+		atomic.StoreInt32(&h.lockRunning, 0)
+	}
+	return
+}
+
+// 执行完成后将锁保留到下一次调度时间, 没有下一次调度或已错过时释放
+func (h *timerTaskHandle) unlock(locker Locker, key string) {
+	defer atomic.StoreInt32(&h.lockRunning, 0)
+	if next := h.getSchedule().Next(time.Now()); !next.IsZero() {
+		if hold := time.Until(next); hold > 0 {
+			if ok, err := locker.Renew(key, h.lockOwner, hold); err != nil {
+				log.ERRORF("hold timer task lock[%s] fail:%v", key, err)
+			} else if !ok {
+				log.WARNF("timer task lock[%s] lost before hold", key)
+			}
+			return
+		}
+	}
+	if err := locker.Unlock(key, h.lockOwner); err != nil {
+		log.ERRORF("unlock timer task lock[%s] fail:%v", key, err)
+	}
+}
+
+// 持有锁执行任务, 每ttl/3续约一次; 续约失败说明锁已丢失, 取消handler的ctx
+func (t *TimerTask) runWithLock(ctx context.Context, handle *timerTaskHandle, locker Locker, key string, ttl time.Duration) {
+	owner := handle.lockOwner
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stopRenew := make(chan struct{})
+	renewDone := make(chan struct{})
+	go func() {
+		defer close(renewDone)
+		ticker := time.NewTicker(ttl / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				ok, err := locker.Renew(key, owner, ttl)
+				if err != nil {
+					log.ERRORF("renew timer task lock[%s] fail:%v", key, err)
+					continue
+				}
+				if !ok {
+					log.WARNF("timer task lock[%s] lost, cancel task(%d)", key, t.Id)
+					cancel()
+					return
+				}
+			case <-stopRenew:
+				return
+			}
+		}
+	}()
+
+	t.RunContext(ctx)
+	close(stopRenew)
+	<-renewDone
+	handle.unlock(locker, key)
+}
+
+// 内存锁, 用于测试或单机部署; 共享同一个MemoryLocker的任务互斥
+type MemoryLocker struct {
+	mu    sync.Mutex
+	locks map[string]*memoryLease
+}
+
+type memoryLease struct {
+	owner    string
+	expireAt time.Time
+}
+
+func NewMemoryLocker() *MemoryLocker {
+	return &MemoryLocker{locks: make(map[string]*memoryLease)}
+}
+
+func (l *MemoryLocker) Lock(key string, owner string, ttl time.Duration) (ok bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if lease, exist := l.locks[key]; exist && lease.owner != owner && now.Before(lease.expireAt) {
+		return false, nil
+	}
+	l.locks[key] = &memoryLease{owner: owner, expireAt: now.Add(ttl)}
+	return true, nil
+}
+
+func (l *MemoryLocker) Renew(key string, owner string, ttl time.Duration) (ok bool, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	lease, exist := l.locks[key]
+	if !exist || lease.owner != owner {
+		return false, nil
+	}
+	lease.expireAt = time.Now().Add(ttl)
+	return true, nil
+}
+
+func (l *MemoryLocker) Unlock(key string, owner string) (err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if lease, exist := l.locks[key]; exist && lease.owner == owner {
+		delete(l.locks, key)
+	}
+	return
+}
@@ -0,0 +1,111 @@
+package task
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_MemoryLocker(t *testing.T) {
+	l := NewMemoryLocker()
+	if ok, _ := l.Lock("job", "a", 50*time.Millisecond); !ok {
+		t.Fatal("a lock fail")
+	}
+	if ok, _ := l.Lock("job", "b", 50*time.Millisecond); ok {
+		t.Fatal("b lock should fail")
+	}
+	if ok, _ := l.Renew("job", "b", 50*time.Millisecond); ok {
+		t.Fatal("b renew should fail")
+	}
+	if ok, _ := l.Renew("job", "a", 50*time.Millisecond); !ok {
+		t.Fatal("a renew fail")
+	}
+	// 过期后其他owner可以获取
+	time.Sleep(60 * time.Millisecond)
+	if ok, _ := l.Lock("job", "b", 50*time.Millisecond); !ok {
+		t.Fatal("b lock after expire fail")
+	}
+	if ok, _ := l.Renew("job", "a", 50*time.Millisecond); ok {
+		t.Fatal("a renew after lost should fail")
+	}
+	l.Unlock("job", "a")
+	if ok, _ := l.Lock("job", "c", 50*time.Millisecond); ok {
+		t.Fatal("unlock by other owner")
+	}
+	l.Unlock("job", "b")
+	if ok, _ := l.Lock("job", "c", 50*time.Millisecond); !ok {
+		t.Fatal("c lock after unlock fail")
+	}
+}
+
+// 按period对齐的调度, 模拟多个实例使用相同的cron表达式
+type alignedSchedule struct {
+	period time.Duration
+}
+
+func (s alignedSchedule) Next(t time.Time) time.Time {
+	return t.Truncate(s.period).Add(s.period)
+}
+
+func Test_TimerLockOneRunPerSlot(t *testing.T) {
+	const period = 100 * time.Millisecond
+	locker := NewMemoryLocker()
+	var mu sync.Mutex
+	runs := make(map[time.Time]int)
+	handler := TimerTaskFunc(func(ctx context.Context) {
+		mu.Lock()
+		runs[time.Now().Truncate(period)]++
+		mu.Unlock()
+	})
+	// 两个handle模拟两个实例, Jitter使其中一个在另一个执行完后才触发
+	options := &TimerOptions{SkipFirstRun: true, Jitter: 40 * time.Millisecond, Locker: locker, LockKey: "shared"}
+	TimerTaskServe()
+	RegisterScheduleTimerTaskHandle(9401, handler, alignedSchedule{period}, false, options)
+	RegisterScheduleTimerTaskHandle(9402, handler, alignedSchedule{period}, false, options)
+	time.Sleep(6 * period)
+	UnregisterTimerTask(9401)
+	UnregisterTimerTask(9402)
+	time.Sleep(period / 2)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(runs) < 3 {
+		t.Fatalf("only %d slots run", len(runs))
+	}
+	for slot, n := range runs {
+		if n != 1 {
+			t.Errorf("slot %v run %d times", slot.Format("15:04:05.000"), n)
+		}
+	}
+}
+
+// 续约总是失败的锁
+type lostLocker struct {
+	*MemoryLocker
+}
+
+func (l lostLocker) Renew(key string, owner string, ttl time.Duration) (ok bool, err error) {
+	return false, nil
+}
+
+func Test_TimerLockRenewFailCancels(t *testing.T) {
+	canceled := make(chan bool, 1)
+	// 过小的LockTTL被调整为最小值, 不会使续约的ticker panic
+	RegisterScheduleTimerTaskHandle(9403, TimerTaskFunc(func(ctx context.Context) {
+		select {
+		case <-ctx.Done():
+			canceled <- true
+		case <-time.After(3 * time.Second):
+			canceled <- false
+		}
+	}), Every(time.Hour), false, &TimerOptions{SkipFirstRun: true, Locker: lostLocker{NewMemoryLocker()}, LockTTL: time.Nanosecond})
+	defer UnregisterTimerTask(9403)
+
+	if err := TriggerTimerTask(9403); err != nil {
+		t.Fatal(err)
+	}
+	if !<-canceled {
+		t.Error("handler ctx not canceled after renew fail")
+	}
+}
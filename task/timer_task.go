@@ -1,6 +1,7 @@
 package task
 
 import (
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,9 +15,21 @@ var (
 	timerTaskPool   = make(map[int32]*TimerTask)
 )
 
+var (
+	// TimerTaskServe已启动, 由timerHandlePoolMu保护
+	timerServing bool
+	// StopAllTimerTasks已调用, 同时持有timerHandlePoolMu和timerTaskPoolMu时修改
+	timerStopped bool
+	// 调度协程
+	timerLoopWait sync.WaitGroup
+	// 正在执行的任务
+	timerRunWait sync.WaitGroup
+	// 定时任务handler的ctx, StopAllTimerTasks时取消
+	timerCtx, timerCancel = context.WithCancel(context.Background())
+)
+
 type TimerTask struct {
 	Id           int32
-	Gid          uint64
 	Type         int32
 	Handler      TimerTaskHandler
 	FuncName     string
@@ -27,31 +40,36 @@ type TimerTask struct {
 	isFinished   chan bool
 }
 
+// 调用方需持有timerTaskPoolMu
 func newTimerTask(tType int32, handle *timerTaskHandle) (task *TimerTask, err error) {
+	handle.mu.Lock()
+	intervalTime := handle.intervalTime
+	handle.mu.Unlock()
 	task = &TimerTask{
 		Id:           atomic.AddInt32(&globalTaskId, 1),
 		Type:         tType,
 		Handler:      handle.handler,
 		State:        stateNew,
-		intervalTime: handle.intervalTime,
+		intervalTime: intervalTime,
 		singleton:    handle.singleton,
 		isFinished:   make(chan bool),
 	}
-	timerTaskPoolMu.Lock()
 	timerTaskPool[task.Id] = task
-	timerTaskPoolMu.Unlock()
 	return
 }
 
 func (t *TimerTask) Run() {
-	funcName := GetTaskFuncName(t.Handler)
+	t.RunContext(context.Background())
+}
+
+func (t *TimerTask) RunContext(ctx context.Context) {
+	t.FuncName = GetTaskFuncName(t.Handler)
+	ctx = withTaskInfo(ctx, &TaskInfo{Type: TaskTypeTimer, Id: t.Id, FuncName: t.FuncName})
 	go func() {
-		t.Gid = common.GetGID()
-		t.FuncName = funcName
 		if common.CheckWrapPanic() {
-			common.GoSafeTimer(t.Handler.ServeTimer)
+			common.GoSafeTimer(func() { t.Handler.ServeTimer(ctx) })
 		} else {
-			t.Handler.ServeTimer()
+			t.Handler.ServeTimer(ctx)
 		}
 		t.isFinished <- true
 	}()
@@ -74,59 +92,140 @@ func TimerTaskServe() {
 func timerTaskServe() {
 	timerHandlePoolMu.Lock()
 	defer timerHandlePoolMu.Unlock()
+	if timerStopped {
+		return
+	}
+	timerServing = true
 	for tType, handle := range timerHandlePool {
-		// 先执行一次
-		task, err := newTimerTask(tType, handle)
-		if err != nil {
-			log.ERRORF("create timer task[%d] fail", tType)
-			continue
+		startTimerLoop(tType, handle)
+	}
+}
+
+// 调用方需持有timerHandlePoolMu
+func startTimerLoop(tType int32, handle *timerTaskHandle) {
+	timerLoopWait.Add(1)
+	go runTimerTask(tType, handle)
+}
+
+func runTimerTask(tType int32, handle *timerTaskHandle) {
+	defer timerLoopWait.Done()
+	defer handle.setNextRun(time.Time{})
+	// 先执行一次
+	if !handle.skipFirstRun && !handle.isPaused() {
+		startTimerTask(tType, handle)
+	}
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+	stopTimer(timer)
+
+	next := handle.getSchedule().Next(time.Now())
+	for {
+		var fire <-chan time.Time
+		var fireAt time.Time
+		if !next.IsZero() && !handle.isPaused() {
+			fireAt = next.Add(handle.jitterDelay())
+			timer.Reset(time.Until(fireAt))
+			fire = timer.C
+		}
+		handle.setNextRun(fireAt)
+
+		select {
+		case <-fire:
+			startTimerTask(tType, handle)
+			// 执行时间过长错过的调度直接跳过
+			schedule := handle.getSchedule()
+			now := time.Now()
+			if next = schedule.Next(next); !next.IsZero() && !next.After(now) {
+				next = schedule.Next(now)
+			}
+		case <-handle.wake:
+			stopTimer(timer)
+			next = handle.getSchedule().Next(time.Now())
+		case <-handle.stop:
+			return
 		}
-		go task.Run()
-		// 设置定时器
-		taskTimer := time.NewTicker(handle.intervalTime)
-		go runTimerTask(tType, handle, taskTimer)
 	}
 }
 
-func runTimerTask(tType int32, handle *timerTaskHandle, t *time.Ticker) {
-	for _ = range t.C {
-		// 判断单例
-		isRunning := false
-		timerTaskPoolMu.Lock()
+func stopTimer(timer *time.Timer) {
+	if !timer.Stop() {
+		select {
+		case <-timer.C:
+		default:
+		}
+	}
+}
+
+func startTimerTask(tType int32, handle *timerTaskHandle) (err error) {
+	timerTaskPoolMu.Lock()
+	if timerStopped {
+		timerTaskPoolMu.Unlock()
+		return ErrTimerTaskStopped
+	}
+	// 判断单例
+	if handle.singleton {
 		for _, rtask := range timerTaskPool {
 			if rtask.Type == tType {
-				if rtask.singleton {
-					isRunning = true
-					break
-				}
+				timerTaskPoolMu.Unlock()
+				return ErrTimerTaskRunning
 			}
 		}
+	}
+	task, err := newTimerTask(tType, handle)
+	if err != nil {
 		timerTaskPoolMu.Unlock()
-		if isRunning {
-			continue
-		}
-		task, err := newTimerTask(tType, handle)
+		log.ERRORF("create timer task fail, type(%d)", tType)
+		return
+	}
+	timerRunWait.Add(1)
+	timerTaskPoolMu.Unlock()
+
+	locker, key, ttl := handle.timerLock(tType)
+	if locker == nil {
+		go func() {
+			defer timerRunWait.Done()
+			task.RunContext(timerCtx)
+		}()
+		return
+	}
+	ok, err := handle.lock(locker, key, ttl)
+	if err != nil || !ok {
+		timerTaskPoolMu.Lock()
+		delete(timerTaskPool, task.Id)
+		timerTaskPoolMu.Unlock()
+		timerRunWait.Done()
 		if err != nil {
-			log.ERRORF("create timer task fail, type(%d)", tType)
-			continue
+			log.ERRORF("lock timer task[%s] fail:%v", key, err)
+			return
 		}
-		go task.Run()
+		return ErrTimerTaskLocked
 	}
+	go func() {
+		defer timerRunWait.Done()
+		task.runWithLock(timerCtx, handle, locker, key, ttl)
+	}()
+	return
 }
 
-func LenTimerTasks() int {
-	return len(timerTaskPool)
-}
-
-func GetTimerTaskByGid(gid uint64) (task interface{}) {
+// 停止所有定时任务的调度, 取消正在执行任务的ctx并等待其返回, 用于进程退出
+// 停止后TriggerTimerTask返回ErrTimerTaskStopped
+func StopAllTimerTasks() {
+	timerHandlePoolMu.Lock()
 	timerTaskPoolMu.Lock()
-	defer timerTaskPoolMu.Unlock()
-	for _, t := range timerTaskPool {
-		if t.Gid == gid {
-			return t
-		}
+	timerStopped = true
+	timerTaskPoolMu.Unlock()
+	for _, handle := range timerHandlePool {
+		handle.stopLoop()
 	}
-	return nil
+	timerHandlePoolMu.Unlock()
+
+	timerLoopWait.Wait()
+	timerCancel()
+	timerRunWait.Wait()
+}
+
+func LenTimerTasks() int {
+	return len(timerTaskPool)
 }
 
 func DumpTimerTasks() (tasks map[int32]*TimerTask) {
@@ -1,26 +1,68 @@
 package task
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/xuhn/optimusprime/common"
 )
 
 type TimerTaskHandler interface {
-	ServeTimer()
+	ServeTimer(ctx context.Context)
 }
 
-type TimerTaskFunc func()
+type TimerTaskFunc func(ctx context.Context)
+
+func (t TimerTaskFunc) ServeTimer(ctx context.Context) {
+	t(ctx)
+}
 
-func (t TimerTaskFunc) ServeTimer() {
-	t()
+// 定时任务选项
+type TimerOptions struct {
+	// 每次执行随机延迟[0, Jitter), 避免多个任务或多个实例同时执行
+	Jitter time.Duration
+	// TimerTaskServe启动时不立即执行一次, 等到第一个调度时间再执行
+	SkipFirstRun bool
+	// cron表达式使用的时区, 为空时使用time.Local; 表达式中的CRON_TZ优先
+	Location *time.Location
+	// 每次执行前获取的分布式锁, 为空时singleton任务使用SetTimerLocker设置的锁;
+	// 执行完成后锁保留到下一次调度时间, 实例间的时钟误差和Jitter需小于调度间隔
+	Locker Locker
+	// 锁的名字, 为空时使用timer_task_<id>
+	LockKey string
+	// 锁的租约时长, 为空时30秒, 最小1秒; 执行时间超过租约的任务会自动续约
+	LockTTL time.Duration
 }
 
 type timerTaskHandle struct {
 	handler      TimerTaskHandler
 	intervalTime time.Duration
 	singleton    bool
+	schedule     Schedule
+	jitter       time.Duration
+	skipFirstRun bool
+	locker       Locker
+	lockKey      string
+	lockTTL      time.Duration
+	// 锁的owner, 每个handle唯一; lockRunning为1时本实例正在持有锁执行
+	lockOwner   string
+	lockRunning int32
+	// 下一次执行时间, UnixNano
+	nextRun int64
+
+	// mu保护运行时可修改的intervalTime, schedule和paused
+	mu     sync.Mutex
+	paused bool
+	// 调度规则或暂停状态变化时唤醒调度协程
+	wake chan struct{}
+	// 关闭后调度协程退出
+	stop     chan struct{}
+	stopOnce sync.Once
 }
 
 var (
@@ -28,15 +70,67 @@ var (
 	timerHandlePool   = make(map[int32]*timerTaskHandle)
 )
 
+var (
+	ErrTimerTaskNotFound = errors.New("can't not find handle")
+	ErrTimerTaskRunning  = errors.New("timer task is running")
+	ErrTimerTaskStopped  = errors.New("timer tasks stopped")
+)
+
 func RegisterTimerTaskHandle(id int32, handler TimerTaskHandler, intervalTime time.Duration, singleton bool) {
+	newHandle := newTimerTaskHandle(handler, Every(intervalTime), singleton, nil)
+	newHandle.intervalTime = intervalTime
+	registerTimerTaskHandle(id, newHandle)
+}
+
+// 按cron表达式注册定时任务, 表达式格式见ParseCron
+func RegisterCronTimerTaskHandle(id int32, handler TimerTaskHandler, spec string, singleton bool, options *TimerOptions) (err error) {
+	var loc *time.Location
+	if options != nil {
+		loc = options.Location
+	}
+	schedule, err := ParseCron(spec, loc)
+	if err != nil {
+		return
+	}
+	RegisterScheduleTimerTaskHandle(id, handler, schedule, singleton, options)
+	return
+}
+
+// 按调度规则注册定时任务, options为空时使用默认选项
+// TimerTaskServe之后注册的任务立即开始调度, 替换同id的任务时旧任务停止调度
+func RegisterScheduleTimerTaskHandle(id int32, handler TimerTaskHandler, schedule Schedule, singleton bool, options *TimerOptions) {
+	registerTimerTaskHandle(id, newTimerTaskHandle(handler, schedule, singleton, options))
+}
+
+func newTimerTaskHandle(handler TimerTaskHandler, schedule Schedule, singleton bool, options *TimerOptions) *timerTaskHandle {
+	newHandle := &timerTaskHandle{
+		handler:   handler,
+		singleton: singleton,
+		schedule:  schedule,
+		wake:      make(chan struct{}, 1),
+		stop:      make(chan struct{}),
+		lockOwner: common.NewUUIDV4().String(),
+	}
+	if options != nil {
+		newHandle.jitter = options.Jitter
+		newHandle.skipFirstRun = options.SkipFirstRun
+		newHandle.locker = options.Locker
+		newHandle.lockKey = options.LockKey
+		newHandle.lockTTL = options.LockTTL
+	}
+	return newHandle
+}
+
+func registerTimerTaskHandle(id int32, newHandle *timerTaskHandle) {
 	timerHandlePoolMu.Lock()
 	defer timerHandlePoolMu.Unlock()
-	newHandle := &timerTaskHandle{
-		handler:      handler,
-		intervalTime: intervalTime,
-		singleton:    singleton,
+	if oldHandle, ok := timerHandlePool[id]; ok {
+		oldHandle.stopLoop()
 	}
 	timerHandlePool[id] = newHandle
+	if timerServing && !timerStopped {
+		startTimerLoop(id, newHandle)
+	}
 }
 
 func GetTimerTaskHandle(id int32) (*timerTaskHandle, error) {
@@ -45,8 +139,145 @@ func GetTimerTaskHandle(id int32) (*timerTaskHandle, error) {
 	if handle, ok := timerHandlePool[id]; ok {
 		return handle, nil
 	} else {
-		return nil, errors.New("can't not find handle")
+		return nil, ErrTimerTaskNotFound
+	}
+}
+
+// 暂停调度, 正在执行的任务不受影响; TriggerTimerTask仍可手动执行
+func PauseTimerTask(id int32) (err error) {
+	handle, err := GetTimerTaskHandle(id)
+	if err != nil {
+		return
+	}
+	handle.setPaused(true)
+	return
+}
+
+// 恢复调度, 下一次执行时间从恢复时开始计算
+func ResumeTimerTask(id int32) (err error) {
+	handle, err := GetTimerTaskHandle(id)
+	if err != nil {
+		return
+	}
+	handle.setPaused(false)
+	return
+}
+
+// 立即执行一次, 不影响调度; 单例任务正在执行时返回ErrTimerTaskRunning, 锁被其他实例持有时返回ErrTimerTaskLocked
+func TriggerTimerTask(id int32) (err error) {
+	handle, err := GetTimerTaskHandle(id)
+	if err != nil {
+		return
+	}
+	return startTimerTask(id, handle)
+}
+
+// 注销定时任务并停止调度, 正在执行的任务会继续执行完
+func UnregisterTimerTask(id int32) (err error) {
+	timerHandlePoolMu.Lock()
+	defer timerHandlePoolMu.Unlock()
+	handle, ok := timerHandlePool[id]
+	if !ok {
+		return ErrTimerTaskNotFound
+	}
+	delete(timerHandlePool, id)
+	handle.stopLoop()
+	return
+}
+
+// 修改执行间隔, 下一次执行时间从修改时开始计算
+func UpdateTimerTaskInterval(id int32, intervalTime time.Duration) (err error) {
+	handle, err := GetTimerTaskHandle(id)
+	if err != nil {
+		return
+	}
+	handle.mu.Lock()
+	handle.intervalTime = intervalTime
+	handle.mu.Unlock()
+	handle.setSchedule(Every(intervalTime))
+	return
+}
+
+// 修改调度规则, 下一次执行时间从修改时开始计算
+func UpdateTimerTaskSchedule(id int32, schedule Schedule) (err error) {
+	handle, err := GetTimerTaskHandle(id)
+	if err != nil {
+		return
+	}
+	handle.setSchedule(schedule)
+	return
+}
+
+func (h *timerTaskHandle) getSchedule() Schedule {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.schedule
+}
+
+func (h *timerTaskHandle) setSchedule(schedule Schedule) {
+	h.mu.Lock()
+	h.schedule = schedule
+	h.mu.Unlock()
+	h.wakeLoop()
+}
+
+func (h *timerTaskHandle) isPaused() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.paused
+}
+
+func (h *timerTaskHandle) setPaused(paused bool) {
+	h.mu.Lock()
+	h.paused = paused
+	h.mu.Unlock()
+	h.wakeLoop()
+}
+
+// 通知调度协程重新计算下一次执行时间
+func (h *timerTaskHandle) wakeLoop() {
+	select {
+	case h.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (h *timerTaskHandle) stopLoop() {
+	h.stopOnce.Do(func() { close(h.stop) })
+}
+
+// 下一次执行时间, TimerTaskServe之前、暂停中或没有下一次时返回零值
+func (h *timerTaskHandle) NextRun() time.Time {
+	next := atomic.LoadInt64(&h.nextRun)
+	if next == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, next)
+}
+
+func (h *timerTaskHandle) setNextRun(t time.Time) {
+	if t.IsZero() {
+		atomic.StoreInt64(&h.nextRun, 0)
+		return
+	}
+	atomic.StoreInt64(&h.nextRun, t.UnixNano())
+}
+
+// 随机延迟
+func (h *timerTaskHandle) jitterDelay() time.Duration {
+	if h.jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(h.jitter)))
+}
+
+// 定时任务的下一次执行时间
+func TimerTaskNextRun(id int32) (next time.Time, err error) {
+	handle, err := GetTimerTaskHandle(id)
+	if err != nil {
+		return
 	}
+	return handle.NextRun(), nil
 }
 
 func DumpTimerTaskHandle() {
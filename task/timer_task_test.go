@@ -0,0 +1,140 @@
+package task
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// 等待cond成立, 超时返回false
+func waitFor(timeout time.Duration, cond func() bool) bool {
+	for deadline := time.Now().Add(timeout); time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		if cond() {
+			return true
+		}
+	}
+	return cond()
+}
+
+// StopAllTimerTasks之后恢复定时任务, 仅用于测试
+func resetTimerTasks() {
+	timerHandlePoolMu.Lock()
+	timerTaskPoolMu.Lock()
+	timerStopped = false
+	timerCtx, timerCancel = context.WithCancel(context.Background())
+	timerTaskPoolMu.Unlock()
+	timerHandlePoolMu.Unlock()
+}
+
+func Test_TimerTaskPauseResume(t *testing.T) {
+	var count int32
+	RegisterTimerTaskHandle(9301, TimerTaskFunc(func(ctx context.Context) {
+		atomic.AddInt32(&count, 1)
+	}), 5*time.Millisecond, false)
+	defer UnregisterTimerTask(9301)
+	TimerTaskServe()
+
+	if !waitFor(time.Second, func() bool { return atomic.LoadInt32(&count) >= 2 }) {
+		t.Fatal("timer task not fired")
+	}
+	if err := PauseTimerTask(9301); err != nil {
+		t.Fatal(err)
+	}
+	handle, _ := GetTimerTaskHandle(9301)
+	if !waitFor(time.Second, func() bool { return handle.NextRun().IsZero() }) {
+		t.Fatal("paused task still scheduled")
+	}
+	// 等待暂停前已开始的执行结束
+	time.Sleep(10 * time.Millisecond)
+	paused := atomic.LoadInt32(&count)
+	time.Sleep(30 * time.Millisecond)
+	if n := atomic.LoadInt32(&count); n != paused {
+		t.Fatalf("paused task fired %d times", n-paused)
+	}
+	if err := ResumeTimerTask(9301); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(time.Second, func() bool { return atomic.LoadInt32(&count) > paused }) {
+		t.Fatal("resumed task not fired")
+	}
+}
+
+func Test_TimerTaskTriggerRunning(t *testing.T) {
+	started := make(chan struct{}, 1)
+	release := make(chan struct{})
+	RegisterScheduleTimerTaskHandle(9302, TimerTaskFunc(func(ctx context.Context) {
+		started <- struct{}{}
+		<-release
+	}), Every(time.Hour), true, &TimerOptions{SkipFirstRun: true})
+	defer UnregisterTimerTask(9302)
+
+	if err := TriggerTimerTask(9302); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if err := TriggerTimerTask(9302); err != ErrTimerTaskRunning {
+		t.Fatalf("trigger running singleton returned %v, want ErrTimerTaskRunning", err)
+	}
+	close(release)
+	if !waitFor(time.Second, func() bool { return TriggerTimerTask(9302) == nil }) {
+		t.Fatal("trigger after task finished fail")
+	}
+	<-started
+	if err := TriggerTimerTask(9399); err != ErrTimerTaskNotFound {
+		t.Errorf("trigger unknown task returned %v", err)
+	}
+}
+
+func Test_TimerTaskUnregister(t *testing.T) {
+	var count int32
+	RegisterTimerTaskHandle(9303, TimerTaskFunc(func(ctx context.Context) {
+		atomic.AddInt32(&count, 1)
+	}), 5*time.Millisecond, false)
+	TimerTaskServe()
+	if !waitFor(time.Second, func() bool { return atomic.LoadInt32(&count) >= 1 }) {
+		t.Fatal("timer task not fired")
+	}
+	handle, _ := GetTimerTaskHandle(9303)
+	if err := UnregisterTimerTask(9303); err != nil {
+		t.Fatal(err)
+	}
+	// 调度协程退出时清除下一次执行时间
+	if !waitFor(time.Second, func() bool { return handle.NextRun().IsZero() }) {
+		t.Fatal("timer loop not stopped")
+	}
+	time.Sleep(10 * time.Millisecond)
+	stopped := atomic.LoadInt32(&count)
+	time.Sleep(30 * time.Millisecond)
+	if n := atomic.LoadInt32(&count); n != stopped {
+		t.Fatalf("unregistered task fired %d times", n-stopped)
+	}
+	if err := UnregisterTimerTask(9303); err != ErrTimerTaskNotFound {
+		t.Errorf("unregister twice returned %v", err)
+	}
+}
+
+func Test_StopAllTimerTasks(t *testing.T) {
+	defer resetTimerTasks()
+	started := make(chan struct{})
+	var returned int32
+	RegisterScheduleTimerTaskHandle(9304, TimerTaskFunc(func(ctx context.Context) {
+		close(started)
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		atomic.StoreInt32(&returned, 1)
+	}), Every(time.Hour), true, &TimerOptions{SkipFirstRun: true})
+	defer UnregisterTimerTask(9304)
+
+	if err := TriggerTimerTask(9304); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	StopAllTimerTasks()
+	if atomic.LoadInt32(&returned) != 1 {
+		t.Error("StopAllTimerTasks returned before the running handler")
+	}
+	if err := TriggerTimerTask(9304); err != ErrTimerTaskStopped {
+		t.Errorf("trigger after stop returned %v, want ErrTimerTaskStopped", err)
+	}
+}
@@ -1,12 +1,10 @@
 package task
 
 import (
-	"errors"
+	"context"
 	"sync"
 	"sync/atomic"
 	"time"
-
-	"github.com/xuhn/optimusprime/common"
 )
 
 var (
@@ -16,13 +14,13 @@ var (
 
 type WsTask struct {
 	Id       int32
-	Gid      uint64
 	Pattern  string
 	Handler  WsTaskHandler
 	FuncName string
 	State    taskState
 	timeOut  time.Duration
 	msgChan  chan []byte
+	runState int32
 }
 
 func NewWsTask(pattern string) (task *WsTask, err error) {
@@ -36,7 +34,7 @@ func NewWsTask(pattern string) (task *WsTask, err error) {
 		Handler: taskHandle.handler,
 		State:   stateNew,
 		timeOut: taskHandle.timeOut,
-		msgChan: make(chan []byte),
+		msgChan: make(chan []byte, 1),
 	}
 	wsTaskPoolMu.Lock()
 	wsTaskPool[task.Id] = task
@@ -44,37 +42,48 @@ func NewWsTask(pattern string) (task *WsTask, err error) {
 	return
 }
 
+// conn为*websocket.Conn等带Done()的连接时, 连接断开后handler的ctx被取消, Run返回ErrTaskCanceled
 func (t *WsTask) Run(req interface{}, conn interface{}) (res []byte, err error) {
+	return t.RunContext(context.Background(), req, conn)
+}
+
+// ctx取消或超时后立即返回, handler通过ctx感知取消; 回包channel有缓冲, 被放弃的handler不会阻塞
+// conn带Done()时(如*websocket.Conn), 连接断开也会取消ctx
+func (t *WsTask) RunContext(ctx context.Context, req interface{}, conn interface{}) (res []byte, err error) {
 	t.setState(stateRun)
-	funcName := GetTaskFuncName(t.Handler)
-	var ok bool
+	t.FuncName = GetTaskFuncName(t.Handler)
+	ctx, cancel := taskContext(ctx, t.timeOut)
+	defer cancel()
+	if dc, ok := conn.(doneConn); ok {
+		var connCancel context.CancelFunc
+		ctx, connCancel = connContext(ctx, dc)
+		defer connCancel()
+	}
+	ctx = withTaskInfo(ctx, &TaskInfo{Type: TaskTypeWs, Id: t.Id, FuncName: t.FuncName})
+	done := make(chan struct{})
 	go func() {
-		t.Gid = common.GetGID()
-		t.FuncName = funcName
-		t.Handler.ServeWs(t.msgChan, req, conn)
+		defer close(done)
+		defer finishTask(&t.runState)
+		t.Handler.ServeWs(ctx, t.msgChan, req, conn)
 	}()
 
-	if t.timeOut > 0 {
-		select {
-		case res, ok = <-t.msgChan:
-			if !ok {
-				err = errors.New("task fail ,close")
-			}
-			t.setState(stateFinished)
-		case <-time.After(t.timeOut):
-			t.setState(stateFinished)
-			err = errors.New("task timet out")
-
-		}
-	} else {
+	var ok bool
+	select {
+	case res, ok = <-t.msgChan:
+	case <-done:
+		// handler返回时可能已写入回包
 		select {
 		case res, ok = <-t.msgChan:
-			if !ok {
-				err = errors.New("task fail ,close")
-			}
-			t.setState(stateFinished)
+		default:
 		}
+	case <-ctx.Done():
+		abandonTask(&t.runState)
+		err = taskContextError(ctx)
+	}
+	if !ok && err == nil {
+		err = ErrTaskClosed
 	}
+	t.setState(stateFinished)
 	wsTaskPoolMu.Lock()
 	delete(wsTaskPool, t.Id)
 	wsTaskPoolMu.Unlock()
@@ -89,17 +98,6 @@ func LenWsTasks() int {
 	return len(wsTaskPool)
 }
 
-func GetWsTaskByGid(gid uint64) (task interface{}) {
-	wsTaskPoolMu.Lock()
-	defer wsTaskPoolMu.Unlock()
-	for _, t := range wsTaskPool {
-		if t.Gid == gid {
-			return t
-		}
-	}
-	return nil
-}
-
 func DumpWsTasks() (tasks map[int32]*WsTask) {
 	tasks = make(map[int32]*WsTask)
 	wsTaskPoolMu.Lock()
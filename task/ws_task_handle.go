@@ -1,20 +1,22 @@
 package task
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"sync"
 	"time"
 )
 
+// 回包写入c(最多一次), 不回包时关闭c; ctx在超时或调用方取消时取消
 type WsTaskHandler interface {
-	ServeWs(c chan []byte, msg interface{}, conn interface{})
+	ServeWs(ctx context.Context, c chan []byte, msg interface{}, conn interface{})
 }
 
-type WsTaskFunc func(c chan []byte, msg interface{}, conn interface{})
+type WsTaskFunc func(ctx context.Context, c chan []byte, msg interface{}, conn interface{})
 
-func (t WsTaskFunc) ServeWs(c chan []byte, msg interface{}, conn interface{}) {
-	t(c, msg, conn)
+func (t WsTaskFunc) ServeWs(ctx context.Context, c chan []byte, msg interface{}, conn interface{}) {
+	t(ctx, c, msg, conn)
 }
 
 type wsTaskHandle struct {